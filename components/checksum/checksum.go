@@ -0,0 +1,124 @@
+// Package checksum implements the Internet checksum (RFC 1071) used by IP,
+// TCP and UDP, its incremental update (RFC 1624) and the pseudo-headers
+// TCP covers for IPv4 and IPv6.
+package checksum
+
+import "encoding/binary"
+
+// ProtocolTCP is the IP protocol number of TCP.
+const ProtocolTCP = 6
+
+// Sum adds b to the running one's complement sum initial, 16 bits at a time
+// in network byte order. An odd trailing byte is padded with zero, so only
+// the last of several chunks summed in a row may have an odd length.
+func Sum(b []byte, initial uint32) uint32 {
+	sum := uint64(initial)
+	for len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return uint32(fold64(sum))
+}
+
+// Fold folds the carries of a running sum into 16 bits.
+func Fold(sum uint32) uint16 {
+	return uint16(fold64(uint64(sum)))
+}
+
+func fold64(sum uint64) uint64 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return sum
+}
+
+// Checksum returns the Internet checksum of b on top of the running sum
+// initial: the one's complement of the folded sum.
+func Checksum(b []byte, initial uint32) uint16 {
+	return ^Fold(Sum(b, initial))
+}
+
+// Update returns the checksum after a 16-bit field covered by it changed
+// from old to new, without summing the data again (RFC 1624, equation 3):
+//
+//	HC' = ~(~HC + ~m + m')
+func Update(hc, old, new uint16) uint16 {
+	sum := uint32(^hc) + uint32(^old) + uint32(new)
+	return ^Fold(sum)
+}
+
+// Update32 is Update for a 32-bit field such as a sequence number.
+func Update32(hc uint16, old, new uint32) uint16 {
+	hc = Update(hc, uint16(old>>16), uint16(new>>16))
+	return Update(hc, uint16(old), uint16(new))
+}
+
+// PseudoHeaderIPv4 returns the running sum of the IPv4 pseudo-header
+// (RFC 9293, section 3.1):
+//
+//	+--------+--------+--------+--------+
+//	|           Source Address          |
+//	+--------+--------+--------+--------+
+//	|         Destination Address       |
+//	+--------+--------+--------+--------+
+//	|  zero  |  PTCL  |    TCP Length   |
+//	+--------+--------+--------+--------+
+func PseudoHeaderIPv4(src, dst [4]byte, proto uint8, length uint16) uint32 {
+	sum := Sum(src[:], 0)
+	sum = Sum(dst[:], sum)
+	return sum + uint32(proto) + uint32(length)
+}
+
+// PseudoHeaderIPv6 returns the running sum of the IPv6 pseudo-header (RFC
+// 8200, section 8.1):
+//
+//	+--------+--------+--------+--------+
+//	|                                   |
+//	+          Source Address           +
+//	|             (16 bytes)            |
+//	+--------+--------+--------+--------+
+//	|                                   |
+//	+        Destination Address        +
+//	|             (16 bytes)            |
+//	+--------+--------+--------+--------+
+//	|   Upper-Layer Packet Length       |
+//	+--------+--------+--------+--------+
+//	|      zero       |  Next Header    |
+//	+--------+--------+--------+--------+
+func PseudoHeaderIPv6(src, dst [16]byte, proto uint8, length uint32) uint32 {
+	sum := Sum(src[:], 0)
+	sum = Sum(dst[:], sum)
+	sum += length>>16 + length&0xffff
+	return uint32(Fold(sum + uint32(proto)))
+}
+
+// TCPIPv4 returns the checksum of a TCP segment sent from src to dst. The
+// checksum field of segment must be zero.
+func TCPIPv4(src, dst [4]byte, segment []byte) uint16 {
+	return Checksum(segment, PseudoHeaderIPv4(src, dst, ProtocolTCP, uint16(len(segment))))
+}
+
+// TCPIPv6 is TCPIPv4 for IPv6 addresses.
+func TCPIPv6(src, dst [16]byte, segment []byte) uint16 {
+	return Checksum(segment, PseudoHeaderIPv6(src, dst, ProtocolTCP, uint32(len(segment))))
+}
+
+// Verify reports whether data, checksum field included, sums up correctly
+// on top of the running sum initial (usually a pseudo-header).
+func Verify(data []byte, initial uint32) bool {
+	return Fold(Sum(data, initial)) == 0xffff
+}
+
+// VerifyTCPIPv4 reports whether the checksum of a received TCP segment is
+// correct.
+func VerifyTCPIPv4(src, dst [4]byte, segment []byte) bool {
+	return Verify(segment, PseudoHeaderIPv4(src, dst, ProtocolTCP, uint16(len(segment))))
+}
+
+// VerifyTCPIPv6 is VerifyTCPIPv4 for IPv6 addresses.
+func VerifyTCPIPv6(src, dst [16]byte, segment []byte) bool {
+	return Verify(segment, PseudoHeaderIPv6(src, dst, ProtocolTCP, uint32(len(segment))))
+}
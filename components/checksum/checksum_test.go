@@ -0,0 +1,182 @@
+package checksum
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// ipv4Header is a sample IPv4 header with its checksum field zeroed; the
+// checksum is 0xb861.
+var ipv4Header = []byte{
+	0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11,
+	0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7,
+}
+
+func TestSum(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		initial uint32
+		want    uint16 // folded
+	}{
+		{name: "empty", b: nil, want: 0},
+		// RFC 1071, section 3
+		{name: "RFC 1071 example", b: []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, want: 0xddf2},
+		{name: "one byte", b: []byte{0xab}, want: 0xab00},
+		{name: "odd length", b: []byte{0x00, 0x01, 0xf2}, want: 0xf201},
+		{name: "initial", b: []byte{0x00, 0x01}, initial: 0xffff, want: 0x0001},
+		{name: "carries", b: []byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x02}, want: 0x0002},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Fold(Sum(tt.b, tt.initial)); got != tt.want {
+				t.Errorf("Fold(Sum) = %#04x, want %#04x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSumInChunks(t *testing.T) {
+	b := make([]byte, 101)
+	rand.New(rand.NewSource(1)).Read(b)
+
+	// Only the last chunk may have an odd length
+	sum := Sum(b[:40], 0)
+	sum = Sum(b[40:100], sum)
+	sum = Sum(b[100:], sum)
+	if Fold(sum) != Fold(Sum(b, 0)) {
+		t.Errorf("chunked sum %#04x, whole sum %#04x", Fold(sum), Fold(Sum(b, 0)))
+	}
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		sum  uint32
+		want uint16
+	}{
+		{0, 0},
+		{0xffff, 0xffff},
+		{0x10000, 0x0001},
+		{0x2ddf0, 0xddf2},
+		{0x1fffe, 0xffff},
+		{0xffffffff, 0xffff},
+	}
+	for _, tt := range tests {
+		if got := Fold(tt.sum); got != tt.want {
+			t.Errorf("Fold(%#x) = %#04x, want %#04x", tt.sum, got, tt.want)
+		}
+	}
+}
+
+func TestChecksumAndVerify(t *testing.T) {
+	if got := Checksum([]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0); got != 0x220d {
+		t.Errorf("RFC 1071 example: checksum %#04x, want 0x220d", got)
+	}
+
+	h := append([]byte(nil), ipv4Header...)
+	sum := Checksum(h, 0)
+	if sum != 0xb861 {
+		t.Fatalf("IPv4 header checksum %#04x, want 0xb861", sum)
+	}
+	binary.BigEndian.PutUint16(h[10:12], sum)
+	if !Verify(h, 0) {
+		t.Error("header with its checksum does not verify")
+	}
+	h[3] ^= 0x01
+	if Verify(h, 0) {
+		t.Error("header with a flipped bit verifies")
+	}
+}
+
+// TestUpdate changes 16- and 32-bit fields of random data and checks that
+// the incrementally updated checksum matches a full recompute.
+func TestUpdate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	b := make([]byte, 64)
+
+	for i := 0; i < 1000; i++ {
+		rng.Read(b)
+		binary.BigEndian.PutUint16(b[16:18], 0)
+		hc := Checksum(b, 0)
+		binary.BigEndian.PutUint16(b[16:18], hc)
+
+		off := 2 * rng.Intn(len(b)/2)
+		if off == 16 {
+			continue
+		}
+		if i%2 == 0 {
+			old := binary.BigEndian.Uint16(b[off:])
+			new := uint16(rng.Uint32())
+			binary.BigEndian.PutUint16(b[off:], new)
+			hc = Update(hc, old, new)
+		} else {
+			off = min(off, len(b)-4)
+			if off == 14 || off == 16 {
+				continue
+			}
+			old := binary.BigEndian.Uint32(b[off:])
+			new := rng.Uint32()
+			binary.BigEndian.PutUint32(b[off:], new)
+			hc = Update32(hc, old, new)
+		}
+
+		binary.BigEndian.PutUint16(b[16:18], 0)
+		if want := Checksum(b, 0); hc != want {
+			t.Fatalf("round %d: updated checksum %#04x, recomputed %#04x", i, hc, want)
+		}
+	}
+}
+
+func TestPseudoHeaders(t *testing.T) {
+	src4 := [4]byte{192, 168, 0, 1}
+	dst4 := [4]byte{10, 0, 0, 2}
+	ph4 := append(append(src4[:], dst4[:]...), 0, ProtocolTCP, 0x05, 0xdc)
+	if got, want := Fold(PseudoHeaderIPv4(src4, dst4, ProtocolTCP, 1500)), Fold(Sum(ph4, 0)); got != want {
+		t.Errorf("IPv4 pseudo-header sum %#04x, want %#04x", got, want)
+	}
+
+	var src6, dst6 [16]byte
+	for i := range src6 {
+		src6[i] = byte(0xf0 + i)
+		dst6[i] = byte(0x20 + 3*i)
+	}
+	// A length above 16 bits makes sure both halves are summed
+	ph6 := append(append(src6[:], dst6[:]...), 0x00, 0x01, 0x86, 0xa0, 0, 0, 0, ProtocolTCP)
+	if got, want := Fold(PseudoHeaderIPv6(src6, dst6, ProtocolTCP, 100000)), Fold(Sum(ph6, 0)); got != want {
+		t.Errorf("IPv6 pseudo-header sum %#04x, want %#04x", got, want)
+	}
+}
+
+func TestTCPRoundTrip(t *testing.T) {
+	segment := make([]byte, 45) // odd length: padded on the wire
+	rand.New(rand.NewSource(2)).Read(segment)
+
+	t.Run("IPv4", func(t *testing.T) {
+		src, dst := [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}
+		s := append([]byte(nil), segment...)
+		binary.BigEndian.PutUint16(s[16:18], 0)
+		binary.BigEndian.PutUint16(s[16:18], TCPIPv4(src, dst, s))
+		if !VerifyTCPIPv4(src, dst, s) {
+			t.Fatal("segment does not verify")
+		}
+		if VerifyTCPIPv4(src, [4]byte{10, 0, 0, 3}, s) {
+			t.Error("segment verifies for another destination")
+		}
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		src, dst := [16]byte{0: 0xfe, 1: 0x80, 15: 1}, [16]byte{0: 0xfe, 1: 0x80, 15: 2}
+		s := append([]byte(nil), segment...)
+		binary.BigEndian.PutUint16(s[16:18], 0)
+		binary.BigEndian.PutUint16(s[16:18], TCPIPv6(src, dst, s))
+		if !VerifyTCPIPv6(src, dst, s) {
+			t.Fatal("segment does not verify")
+		}
+		s[44] ^= 0x80
+		if VerifyTCPIPv6(src, dst, s) {
+			t.Error("segment with a flipped bit verifies")
+		}
+	})
+}
@@ -0,0 +1,43 @@
+// Package clock lets the stack's timers run on either the wall clock or a
+// fake one that only moves when told to, so simulated runs can cover hours
+// of protocol time in milliseconds and come out the same every time.
+package clock
+
+import "time"
+
+// Clock tells the time and schedules functions, like package time.
+type Clock interface {
+	Now() time.Time
+
+	// AfterFunc calls f in its own goroutine, or from Fake.Advance, once d
+	// has elapsed.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending AfterFunc call.
+type Timer interface {
+	// Stop cancels the call. It returns false if the call already ran or
+	// was stopped.
+	Stop() bool
+}
+
+// Real is the wall clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Since returns the time elapsed on c since t.
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Until returns the duration on c until t.
+func Until(c Clock, t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
@@ -0,0 +1,128 @@
+package clock
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Fake is a clock that stands still until Advance moves it. Timers due in
+// the interval run from Advance, one after the other in the order they are
+// due, with Now reporting the time each one was due at.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers fakeTimers
+	seq    uint64
+}
+
+// NewFake returns a fake clock set to start.
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq++
+	t := &fakeTimer{clock: f, when: f.now.Add(d), seq: f.seq, fn: fn, index: -1}
+	heap.Push(&f.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and runs the timers that become due.
+// Timers those set up run as well if they are due by the end of d. The
+// callers of Advance must not hold locks the timer functions take.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	end := f.now.Add(d)
+	for f.timers.Len() > 0 && !f.timers[0].when.After(end) {
+		t := heap.Pop(&f.timers).(*fakeTimer)
+		if t.when.After(f.now) {
+			f.now = t.when
+		}
+		f.mu.Unlock()
+		t.fn()
+		f.mu.Lock()
+	}
+	f.now = end
+	f.mu.Unlock()
+}
+
+// Next returns how long until the earliest pending timer is due, and false
+// if there is none. Advancing by it runs exactly that timer and the ones
+// due at the same time.
+func (f *Fake) Next() (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.timers.Len() == 0 {
+		return 0, false
+	}
+	return max(f.timers[0].when.Sub(f.now), 0), true
+}
+
+// Pending returns the number of timers not run or stopped yet.
+func (f *Fake) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.timers.Len()
+}
+
+type fakeTimer struct {
+	clock *Fake
+	when  time.Time
+	seq   uint64
+	fn    func()
+	index int // position in clock.timers, -1 once it ran or was stopped
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	return true
+}
+
+// fakeTimers is a min-heap of timers by due time, then creation order.
+type fakeTimers []*fakeTimer
+
+func (h fakeTimers) Len() int { return len(h) }
+
+func (h fakeTimers) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h fakeTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *fakeTimers) Push(x any) {
+	t := x.(*fakeTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *fakeTimers) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
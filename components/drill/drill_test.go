@@ -0,0 +1,38 @@
+package drill
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestScripts runs every script in scripts/ against tcplay on a pipe link.
+func TestScripts(t *testing.T) {
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	names, err := filepath.Glob("scripts/*.pkt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) == 0 {
+		t.Fatal("no scripts found")
+	}
+
+	for _, name := range names {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			s, err := ParseFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r Runner
+			if err := r.Run(s); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,539 @@
+package drill
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"tcplay/components/checksum"
+	"tcplay/components/clock"
+	"tcplay/components/link"
+	"tcplay/core"
+	"tcplay/core/ip"
+	"tcplay/protocol"
+	"time"
+)
+
+// Addresses of the two ends. tcplay listens on localPort; the script's end
+// sends from remotePort.
+var (
+	localIP  = [4]byte{192, 168, 0, 1}
+	remoteIP = [4]byte{192, 0, 2, 1}
+)
+
+const (
+	localPort  = 8080
+	remotePort = 40000
+
+	// defaultWindow is the window of inbound segments that state none.
+	defaultWindow = 65535
+)
+
+// Runner runs scripts against a fresh tcplay stack each.
+type Runner struct {
+	// Config is used for tcplay's connections. Its Clock is replaced with
+	// the script's fake clock.
+	Config core.Config
+
+	// Settle is how much real time the stack gets to react before the
+	// clock moves on, 5ms if zero.
+	Settle time.Duration
+
+	// Wait bounds the real time spent waiting for an expected segment or
+	// a blocking call, 1s if zero.
+	Wait time.Duration
+}
+
+// Run runs s and returns the first mismatch between the script and what
+// tcplay did.
+func (r *Runner) Run(s *Script) error {
+	rn := r.newRun()
+	defer rn.close()
+
+	for _, step := range s.Steps {
+		if err := rn.step(step); err != nil {
+			return fmt.Errorf("%s:%d: %v", s.Name, step.Line, err)
+		}
+	}
+	if err := rn.finish(); err != nil {
+		return fmt.Errorf("%s: %v", s.Name, err)
+	}
+	return nil
+}
+
+// run is the state of one script run.
+type run struct {
+	cfg    core.Config
+	settle time.Duration
+	wait   time.Duration
+
+	clock *clock.Fake
+	start time.Time
+	demux *core.Demux
+	peer  *link.PipeEndpoint
+	out   chan emitted
+
+	listener *core.Listener
+	conn     *core.TCPConnection
+	pending  *pendingCall
+
+	// tcplay's port, initial sequence number and timestamp, learned from
+	// its SYN
+	port     uint16
+	iss      uint32
+	issKnown bool
+	tsBase   uint32
+}
+
+// emitted is a packet tcplay sent and the script time it was sent at.
+type emitted struct {
+	pkt []byte
+	at  time.Duration
+}
+
+type pendingCall struct {
+	step   Step
+	done   chan struct{}
+	result string
+	conn   *core.TCPConnection // accepted connection
+}
+
+func (r *Runner) newRun() *run {
+	rn := &run{
+		cfg:    r.Config,
+		settle: r.Settle,
+		wait:   r.Wait,
+		clock:  clock.NewFake(time.Unix(0, 0)),
+		out:    make(chan emitted, 1024),
+		port:   localPort,
+	}
+	if rn.settle <= 0 {
+		rn.settle = 5 * time.Millisecond
+	}
+	if rn.wait <= 0 {
+		rn.wait = time.Second
+	}
+	rn.cfg.Clock = rn.clock
+	rn.start = rn.clock.Now()
+
+	ep, peer := link.Pipe()
+	rn.demux = core.NewLinkDemux(ep, localIP)
+	rn.peer = peer
+
+	go rn.capture()
+	return rn
+}
+
+// capture stamps every packet tcplay sends with the script time.
+func (rn *run) capture() {
+	buf := make([]byte, 65535)
+	for {
+		n, err := rn.peer.ReadPacket(buf)
+		if err != nil {
+			close(rn.out)
+			return
+		}
+		rn.out <- emitted{pkt: append([]byte(nil), buf[:n]...), at: rn.now()}
+	}
+}
+
+func (rn *run) close() {
+	if rn.conn != nil {
+		rn.conn.Abort()
+	}
+	if rn.listener != nil {
+		rn.listener.Close()
+	}
+	rn.demux.Close()
+	rn.peer.Close()
+}
+
+func (rn *run) now() time.Duration {
+	return rn.clock.Now().Sub(rn.start)
+}
+
+func (rn *run) step(step Step) error {
+	rn.advanceTo(step.Time)
+
+	switch {
+	case step.Segment != nil && step.Inbound:
+		if err := rn.expectNone(); err != nil {
+			return err
+		}
+		if err := rn.inject(step.Segment); err != nil {
+			return err
+		}
+		time.Sleep(rn.settle)
+		return nil
+	case step.Segment != nil:
+		return rn.expect(step)
+	default:
+		return rn.call(step)
+	}
+}
+
+// advanceTo moves the clock to t one timer at a time, so that whatever a
+// timer sends is stamped with the time it fired at.
+func (rn *run) advanceTo(t time.Duration) {
+	for {
+		time.Sleep(rn.settle)
+		now := rn.now()
+		if now >= t {
+			return
+		}
+		next, ok := rn.clock.Next()
+		if !ok || now+next > t {
+			rn.clock.Advance(t - now)
+			time.Sleep(rn.settle)
+			return
+		}
+		rn.clock.Advance(next)
+	}
+}
+
+// inject sends a segment from the script's end to tcplay.
+func (rn *run) inject(seg *Segment) error {
+	h := &protocol.TCPHeader{
+		SourcePort:   remotePort,
+		DestPort:     rn.port,
+		SeqNum:       seg.Seq,
+		ControlFlags: seg.Flags,
+		WindowSize:   defaultWindow,
+		Options:      append([]protocol.Option(nil), seg.Options...),
+	}
+	if seg.Window != nil {
+		h.WindowSize = *seg.Window
+	}
+	if seg.Flags&protocol.ACK != 0 {
+		if !rn.issKnown {
+			return fmt.Errorf("inbound ACK before tcplay sent its SYN")
+		}
+		h.AckNum = rn.iss + seg.Ack
+	}
+	for i, o := range h.Options {
+		switch o := o.(type) {
+		case protocol.SACKOption:
+			blocks := make([]protocol.SACKBlock, len(o.Blocks))
+			for j, blk := range o.Blocks {
+				blocks[j] = protocol.SACKBlock{Left: rn.iss + blk.Left, Right: rn.iss + blk.Right}
+			}
+			h.Options[i] = protocol.SACKOption{Blocks: blocks}
+		case protocol.TimestampsOption:
+			// TSecr echoes tcplay's clock, but only on an ACK
+			if seg.Flags&protocol.ACK != 0 {
+				o.TSecr += rn.tsBase
+			}
+			h.Options[i] = o
+		}
+	}
+
+	payload := make([]byte, seg.Len)
+	for i := range payload {
+		payload[i] = byte('a' + i%26)
+	}
+
+	buf, err := h.Serialize()
+	if err != nil {
+		return err
+	}
+	buf = append(buf, payload...)
+	sum := checksum.TCPIPv4(remoteIP, localIP, buf)
+	buf[16], buf[17] = byte(sum>>8), byte(sum)
+
+	ipHeader := &ip.IPHeader{
+		Version:  4,
+		IHL:      5,
+		TotalLen: uint16(20 + len(buf)),
+		TTL:      64,
+		Protocol: checksum.ProtocolTCP,
+		SrcAddr:  remoteIP,
+		DstAddr:  localIP,
+	}
+	return rn.peer.WritePacket(append(ipHeader.Marshall(), buf...))
+}
+
+// expect takes the next segment tcplay sent and compares it with step.
+func (rn *run) expect(step Step) error {
+	want := step.Segment
+
+	var e emitted
+	select {
+	case e = <-rn.out:
+	case <-time.After(rn.wait):
+		return fmt.Errorf("expected segment not sent:\n\twant: > %s at %s", want, seconds(step.Time))
+	}
+
+	got, err := rn.decode(e.pkt)
+	if err != nil {
+		return err
+	}
+
+	var diffs []string
+	if got.Flags != want.Flags {
+		diffs = append(diffs, "flags")
+	}
+	if got.Seq != want.Seq || got.Len != want.Len {
+		diffs = append(diffs, "sequence numbers")
+	}
+	if want.Flags&protocol.ACK != 0 && got.Ack != want.Ack {
+		diffs = append(diffs, "ack")
+	}
+	if want.Window != nil && *got.Window != *want.Window {
+		diffs = append(diffs, "window")
+	}
+	if want.HasOpts && optionsString(got.Options) != optionsString(want.Options) {
+		diffs = append(diffs, "options")
+	}
+	if e.at != step.Time {
+		diffs = append(diffs, "time")
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("outbound segment differs in %s:\n\twant: > %s at %s\n\tgot:  > %s at %s",
+			strings.Join(diffs, ", "), want, seconds(step.Time), got, seconds(e.at))
+	}
+	return nil
+}
+
+// expectNone fails if tcplay sent a segment the script does not expect.
+func (rn *run) expectNone() error {
+	select {
+	case e, ok := <-rn.out:
+		if !ok {
+			return nil
+		}
+		got, err := rn.decode(e.pkt)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("unexpected outbound segment:\n\tgot:  > %s at %s", got, seconds(e.at))
+	default:
+		return nil
+	}
+}
+
+// decode parses a packet tcplay sent into script terms. The first SYN
+// tells tcplay's port and initial sequence number.
+func (rn *run) decode(pkt []byte) (*Segment, error) {
+	ipHeader, err := ip.Serialize(pkt)
+	if err != nil {
+		return nil, err
+	}
+	if int(ipHeader.TotalLen) > len(pkt) || int(ipHeader.IHL)*4 > int(ipHeader.TotalLen) {
+		return nil, fmt.Errorf("outbound packet with bad IP header")
+	}
+	tcp := pkt[int(ipHeader.IHL)*4 : ipHeader.TotalLen]
+	if !checksum.VerifyTCPIPv4(ipHeader.SrcAddr, ipHeader.DstAddr, tcp) {
+		return nil, fmt.Errorf("outbound segment with bad checksum")
+	}
+
+	h, payload, err := protocol.ParseTCPHeader(tcp)
+	if err != nil {
+		return nil, fmt.Errorf("malformed outbound segment: %v", err)
+	}
+	if h.ControlFlags&protocol.SYN != 0 && !rn.issKnown {
+		rn.iss, rn.issKnown = h.SeqNum, true
+		rn.port = h.SourcePort
+		if ts, ok := h.Option(protocol.OptionTimestamps).(protocol.TimestampsOption); ok {
+			rn.tsBase = ts.TSval
+		}
+	}
+	for i, o := range h.Options {
+		if ts, ok := o.(protocol.TimestampsOption); ok {
+			ts.TSval -= rn.tsBase
+			h.Options[i] = ts
+		}
+	}
+
+	win := h.WindowSize
+	return &Segment{
+		Flags:   h.ControlFlags,
+		Seq:     h.SeqNum - rn.iss,
+		Len:     len(payload),
+		Ack:     h.AckNum,
+		Window:  &win,
+		Options: h.Options,
+		HasOpts: true,
+	}, nil
+}
+
+// call makes the call of step. It runs in the background until it returns
+// or the next call comes up, as blocking calls typically return only after
+// segments that follow in the script.
+func (rn *run) call(step Step) error {
+	if err := rn.waitPending(); err != nil {
+		return err
+	}
+
+	c := step.Call
+	p := &pendingCall{step: step, done: make(chan struct{})}
+	var fn func() (int, error)
+	switch c.Name {
+	case "listen":
+		l, err := rn.demux.Listen(localPort, 0)
+		if err == nil {
+			l.SetConfig(rn.cfg)
+			rn.listener = l
+		}
+		return rn.checkResult(step, 0, err)
+	case "connect":
+		conn, err := rn.demux.CreateConnection(remotePort, remoteIP)
+		if err != nil {
+			return rn.checkResult(step, 0, err)
+		}
+		conn.SetConfig(rn.cfg)
+		rn.conn = conn
+		fn = func() (int, error) { return 0, conn.Connect() }
+	case "accept":
+		if rn.listener == nil {
+			return fmt.Errorf("accept without listen")
+		}
+		l := rn.listener
+		fn = func() (int, error) {
+			conn, err := l.Accept()
+			p.conn = conn
+			return 0, err
+		}
+	default:
+		if rn.conn == nil {
+			return fmt.Errorf("%s without a connection", c.Name)
+		}
+		fn = rn.connCall(c)
+	}
+
+	go func() {
+		n, err := fn()
+		p.result = result(c.Name, n, err)
+		close(p.done)
+	}()
+	rn.pending = p
+
+	select {
+	case <-p.done:
+		return rn.waitPending()
+	case <-time.After(rn.settle):
+		return nil
+	}
+}
+
+// connCall returns the function making call c on the connection.
+func (rn *run) connCall(c *Call) func() (int, error) {
+	conn := rn.conn
+	switch c.Name {
+	case "write":
+		return func() (int, error) {
+			data := make([]byte, c.Arg)
+			for i := range data {
+				data[i] = byte('A' + i%26)
+			}
+			return conn.Write(data)
+		}
+	case "read":
+		return func() (int, error) { return conn.Read(make([]byte, c.Arg)) }
+	case "nodelay":
+		return func() (int, error) { return 0, conn.SetNoDelay(c.Arg != 0) }
+	case "cork":
+		return func() (int, error) { return 0, conn.SetCork(c.Arg != 0) }
+	case "quickack":
+		return func() (int, error) { return 0, conn.SetQuickAck(c.Arg != 0) }
+	case "shutdown":
+		return func() (int, error) { return 0, conn.CloseWrite() }
+	case "close":
+		return func() (int, error) { return 0, conn.Close() }
+	}
+	return func() (int, error) { return 0, conn.Abort() }
+}
+
+// waitPending waits for the call still running, if any, and checks its
+// result.
+func (rn *run) waitPending() error {
+	p := rn.pending
+	if p == nil {
+		return nil
+	}
+	select {
+	case <-p.done:
+	case <-time.After(rn.wait):
+		return fmt.Errorf("%s from line %d did not return", p.step.Call.Name, p.step.Line)
+	}
+	rn.pending = nil
+	if p.conn != nil {
+		rn.conn = p.conn
+	}
+
+	if want := p.step.Call.Result; want != "" && want != p.result {
+		return fmt.Errorf("%s from line %d returned %s, want %s", p.step.Call.Name, p.step.Line, p.result, want)
+	}
+	return nil
+}
+
+func (rn *run) checkResult(step Step, n int, err error) error {
+	got := result(step.Call.Name, n, err)
+	if want := step.Call.Result; want != "" && want != got {
+		return fmt.Errorf("%s returned %s, want %s", step.Call.Name, got, want)
+	}
+	return nil
+}
+
+// finish checks that tcplay sent nothing more and every call returned.
+func (rn *run) finish() error {
+	time.Sleep(rn.settle)
+	if err := rn.expectNone(); err != nil {
+		return err
+	}
+	return rn.waitPending()
+}
+
+// result formats what a call returned the way a script states it.
+func result(name string, n int, err error) string {
+	if err == nil {
+		if calls[name] {
+			return strconv.Itoa(n)
+		}
+		return "0"
+	}
+
+	var errno syscall.Errno
+	var timeout *core.TimeoutError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "EOF"
+	case errors.As(err, &timeout):
+		return "ETIMEDOUT"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "EAGAIN"
+	case errors.Is(err, net.ErrClosed):
+		return "EBADF"
+	case errors.As(err, &errno):
+		for name, e := range errnoNames {
+			if e == errno {
+				return name
+			}
+		}
+	}
+	return strconv.Quote(err.Error())
+}
+
+var errnoNames = map[string]syscall.Errno{
+	"ECONNRESET":   syscall.ECONNRESET,
+	"ECONNREFUSED": syscall.ECONNREFUSED,
+	"ECONNABORTED": syscall.ECONNABORTED,
+	"EPIPE":        syscall.EPIPE,
+}
+
+func optionsString(opts []protocol.Option) string {
+	s := make([]string, len(opts))
+	for i, o := range opts {
+		s[i] = formatOption(o)
+	}
+	return strings.Join(s, ",")
+}
+
+// seconds formats a script time like the scripts do.
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
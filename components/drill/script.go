@@ -0,0 +1,391 @@
+// Package drill runs packetdrill-style scripts against tcplay. A script is
+// a timeline of segments injected into the stack, segments the stack must
+// send, and calls made on its API:
+//
+//	// passive open, one request and the answer
+//	0.000 listen
+//	+0    < S 0:0(0) win 65535 <mss 1460>
+//	+0    > S. 0:0(0) ack 1 win 65535 <mss 1460>
+//	+.1   < . 1:1(0) ack 1 win 65535
+//	+0    accept = 0
+//	+0    < P. 1:11(10) ack 1 win 65535
+//	+0    > . 1:1(0) ack 11
+//	+0    read 10 = 10
+//
+// Times are in seconds, absolute or relative to the previous line (+). The
+// clock is a clock.Fake, so a script covers minutes of protocol time
+// without waiting for them.
+//
+// Segments are written as "<" for inbound and ">" for outbound, followed by
+// the flags (S, F, R, P, "." for ACK), start:end(length), and optionally the
+// ack number, window and options in angle brackets. Sequence numbers are
+// relative to the initial sequence number of the side that sends them; the
+// script's side starts at 0. tcplay's timestamps are relative to the one
+// in its SYN, so they count milliseconds from there. An outbound segment is
+// only checked for the window and options if the script states them.
+//
+// Calls are listen, accept, connect, write N, read N, nodelay 0|1, cork 0|1,
+// quickack 0|1, shutdown, close and abort, optionally followed by
+// "= result": 0 for success, the byte count for read and write, or an error
+// name such as EOF or ECONNRESET.
+package drill
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"tcplay/protocol"
+	"time"
+)
+
+// Script is a parsed script.
+type Script struct {
+	Name  string
+	Steps []Step
+}
+
+// Step is one line of a script. Exactly one of Segment and Call is set.
+type Step struct {
+	Line    int
+	Time    time.Duration // since the start of the script
+	Inbound bool          // Segment is injected rather than expected
+	Segment *Segment
+	Call    *Call
+}
+
+// Segment describes a segment. Nil Window and Options are not checked on
+// outbound segments.
+type Segment struct {
+	Flags   uint8
+	Seq     uint32
+	Len     int
+	Ack     uint32
+	Window  *uint16
+	Options []protocol.Option
+	HasOpts bool
+}
+
+// Call is a call on tcplay's API. Result is empty if the script does not
+// check it.
+type Call struct {
+	Name   string
+	Arg    int
+	Result string
+}
+
+// ParseFile reads and parses the script in the named file.
+func ParseFile(name string) (*Script, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(name, f)
+}
+
+// Parse parses a script read from r. name is used in error messages.
+func Parse(name string, r io.Reader) (*Script, error) {
+	s := &Script{Name: name}
+	var now time.Duration
+
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.Index(text, "//"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: time without event", name, line)
+		}
+
+		t, err := parseTime(fields[0], now)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		if t < now {
+			return nil, fmt.Errorf("%s:%d: time goes backwards", name, line)
+		}
+		now = t
+
+		step := Step{Line: line, Time: t}
+		switch fields[1] {
+		case "<", ">":
+			step.Inbound = fields[1] == "<"
+			step.Segment, err = parseSegment(fields[2:])
+		default:
+			step.Call, err = parseCall(fields[1:])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		s.Steps = append(s.Steps, step)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseTime parses an absolute time or one relative to now ("+0.1").
+func parseTime(field string, now time.Duration) (time.Duration, error) {
+	rel := strings.HasPrefix(field, "+")
+	secs, err := strconv.ParseFloat(strings.TrimPrefix(field, "+"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", field)
+	}
+	t := time.Duration(secs * float64(time.Second))
+	if rel {
+		t += now
+	}
+	return t, nil
+}
+
+// parseSegment parses "S. 0:0(0) ack 1 win 65535 <mss 1460>".
+func parseSegment(fields []string) (*Segment, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("segment needs flags and sequence numbers")
+	}
+
+	seg := &Segment{}
+	for _, f := range fields[0] {
+		switch f {
+		case 'S':
+			seg.Flags |= protocol.SYN
+		case 'F':
+			seg.Flags |= protocol.FIN
+		case 'R':
+			seg.Flags |= protocol.RST
+		case 'P':
+			seg.Flags |= protocol.PSH
+		case '.':
+			seg.Flags |= protocol.ACK
+		default:
+			return nil, fmt.Errorf("unknown flag %q", f)
+		}
+	}
+
+	var start, end uint32
+	if _, err := fmt.Sscanf(fields[1], "%d:%d(%d)", &start, &end, &seg.Len); err != nil {
+		return nil, fmt.Errorf("bad sequence numbers %q", fields[1])
+	}
+	if end-start != uint32(seg.Len) {
+		return nil, fmt.Errorf("%s: length does not match the range", fields[1])
+	}
+	seg.Seq = start
+
+	rest := fields[2:]
+	for len(rest) > 0 {
+		switch {
+		case rest[0] == "ack" && len(rest) > 1:
+			n, err := strconv.ParseUint(rest[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad ack %q", rest[1])
+			}
+			seg.Ack = uint32(n)
+			rest = rest[2:]
+		case rest[0] == "win" && len(rest) > 1:
+			n, err := strconv.ParseUint(rest[1], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("bad window %q", rest[1])
+			}
+			w := uint16(n)
+			seg.Window = &w
+			rest = rest[2:]
+		case strings.HasPrefix(rest[0], "<"):
+			opts, err := parseOptions(strings.Join(rest, " "))
+			if err != nil {
+				return nil, err
+			}
+			seg.Options, seg.HasOpts = opts, true
+			rest = nil
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest[0])
+		}
+	}
+
+	if seg.Ack != 0 && seg.Flags&protocol.ACK == 0 {
+		return nil, fmt.Errorf("ack number without ACK flag")
+	}
+	return seg, nil
+}
+
+// parseOptions parses "<mss 1460,sackOK,TS val 1 ecr 0,nop,wscale 7>".
+func parseOptions(text string) ([]protocol.Option, error) {
+	if !strings.HasPrefix(text, "<") || !strings.HasSuffix(text, ">") {
+		return nil, fmt.Errorf("bad options %q", text)
+	}
+	text = strings.TrimSpace(text[1 : len(text)-1])
+	if text == "" {
+		return nil, nil
+	}
+
+	var opts []protocol.Option
+	for _, item := range strings.Split(text, ",") {
+		f := strings.Fields(item)
+		if len(f) == 0 {
+			return nil, fmt.Errorf("empty option in %q", text)
+		}
+
+		var nums []uint64
+		for _, s := range f[1:] {
+			if s == "val" || s == "ecr" {
+				continue
+			}
+			if l, r, ok := strings.Cut(s, ":"); ok {
+				ln, err1 := strconv.ParseUint(l, 10, 32)
+				rn, err2 := strconv.ParseUint(r, 10, 32)
+				if err1 != nil || err2 != nil {
+					return nil, fmt.Errorf("bad SACK block %q", s)
+				}
+				nums = append(nums, ln, rn)
+				continue
+			}
+			n, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad option %q", item)
+			}
+			nums = append(nums, n)
+		}
+
+		arity := map[string]int{"nop": 0, "eol": 0, "sackOK": 0, "mss": 1, "wscale": 1, "TS": 2}
+		want, known := arity[f[0]]
+		if f[0] == "sack" {
+			want, known = len(nums)&^1, len(nums) > 0
+		}
+		if !known || len(nums) != want {
+			return nil, fmt.Errorf("bad option %q", item)
+		}
+
+		switch f[0] {
+		case "nop":
+			opts = append(opts, protocol.NOPOption{})
+		case "eol":
+			opts = append(opts, protocol.EOLOption{})
+		case "sackOK":
+			opts = append(opts, protocol.SACKPermittedOption{})
+		case "mss":
+			opts = append(opts, protocol.MSSOption{MSS: uint16(nums[0])})
+		case "wscale":
+			opts = append(opts, protocol.WindowScaleOption{Shift: uint8(nums[0])})
+		case "TS":
+			opts = append(opts, protocol.TimestampsOption{TSval: uint32(nums[0]), TSecr: uint32(nums[1])})
+		case "sack":
+			var blocks []protocol.SACKBlock
+			for i := 0; i < len(nums); i += 2 {
+				blocks = append(blocks, protocol.SACKBlock{Left: uint32(nums[i]), Right: uint32(nums[i+1])})
+			}
+			opts = append(opts, protocol.SACKOption{Blocks: blocks})
+		}
+	}
+	return opts, nil
+}
+
+// calls lists the calls a script can make and whether they take a number:
+// a byte count, or 0 or 1 for an option.
+var calls = map[string]bool{
+	"listen":   false,
+	"accept":   false,
+	"connect":  false,
+	"write":    true,
+	"read":     true,
+	"nodelay":  true,
+	"cork":     true,
+	"quickack": true,
+	"shutdown": false,
+	"close":    false,
+	"abort":    false,
+}
+
+// parseCall parses "write 10 = 10".
+func parseCall(fields []string) (*Call, error) {
+	call := &Call{Name: fields[0]}
+	takesArg, ok := calls[call.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown call %q", call.Name)
+	}
+	rest := fields[1:]
+
+	if takesArg {
+		if len(rest) == 0 {
+			return nil, fmt.Errorf("%s needs a number", call.Name)
+		}
+		n, err := strconv.Atoi(rest[0])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad number %q", rest[0])
+		}
+		call.Arg = n
+		rest = rest[1:]
+	}
+
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && rest[0] == "=":
+		call.Result = rest[1]
+	default:
+		return nil, fmt.Errorf("unexpected %q", strings.Join(rest, " "))
+	}
+	return call, nil
+}
+
+// String formats seg the way a script writes it. Segments from the script
+// leave out what they do not check.
+func (seg *Segment) String() string {
+	var b strings.Builder
+	for _, f := range []struct {
+		bit  uint8
+		name byte
+	}{{protocol.SYN, 'S'}, {protocol.FIN, 'F'}, {protocol.RST, 'R'}, {protocol.PSH, 'P'}, {protocol.ACK, '.'}} {
+		if seg.Flags&f.bit != 0 {
+			b.WriteByte(f.name)
+		}
+	}
+	fmt.Fprintf(&b, " %d:%d(%d)", seg.Seq, seg.Seq+uint32(seg.Len), seg.Len)
+	if seg.Flags&protocol.ACK != 0 {
+		fmt.Fprintf(&b, " ack %d", seg.Ack)
+	}
+	if seg.Window != nil {
+		fmt.Fprintf(&b, " win %d", *seg.Window)
+	}
+	if seg.HasOpts {
+		b.WriteString(" <")
+		for i, o := range seg.Options {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(formatOption(o))
+		}
+		b.WriteString(">")
+	}
+	return b.String()
+}
+
+func formatOption(o protocol.Option) string {
+	switch o := o.(type) {
+	case protocol.NOPOption:
+		return "nop"
+	case protocol.EOLOption:
+		return "eol"
+	case protocol.SACKPermittedOption:
+		return "sackOK"
+	case protocol.MSSOption:
+		return fmt.Sprintf("mss %d", o.MSS)
+	case protocol.WindowScaleOption:
+		return fmt.Sprintf("wscale %d", o.Shift)
+	case protocol.TimestampsOption:
+		return fmt.Sprintf("TS val %d ecr %d", o.TSval, o.TSecr)
+	case protocol.SACKOption:
+		s := "sack"
+		for _, blk := range o.Blocks {
+			s += fmt.Sprintf(" %d:%d", blk.Left, blk.Right)
+		}
+		return s
+	}
+	return fmt.Sprintf("kind %d", o.Kind())
+}
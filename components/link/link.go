@@ -0,0 +1,9 @@
+// Package link provides the endpoints tcplay sends and receives IPv4
+// packets through. Each of them satisfies core.LinkEndpoint:
+//
+//   - RawSocket shares the host's IP stack through a raw socket
+//   - TUN owns a Linux TUN device, so the kernel's TCP never sees the
+//     segments and cannot answer them with RSTs
+//   - PipeEndpoint is one end of an in-memory link between two stacks in
+//     the same process
+package link
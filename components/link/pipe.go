@@ -0,0 +1,71 @@
+package link
+
+import (
+	"net"
+	"sync"
+)
+
+// pipeQueueLen is the number of packets in flight in each direction before
+// the pipe starts dropping them, like a full transmit queue.
+const pipeQueueLen = 256
+
+// PipeEndpoint is one end of an in-memory link created by Pipe.
+type PipeEndpoint struct {
+	in   <-chan []byte
+	out  chan<- []byte
+	done chan struct{}
+	once sync.Once
+}
+
+// Pipe returns the two ends of an in-memory link: a packet written to one
+// end is read from the other. Packets are copied, never reordered, and only
+// dropped when the peer falls pipeQueueLen packets behind.
+func Pipe() (*PipeEndpoint, *PipeEndpoint) {
+	ab := make(chan []byte, pipeQueueLen)
+	ba := make(chan []byte, pipeQueueLen)
+
+	a := &PipeEndpoint{in: ba, out: ab, done: make(chan struct{})}
+	b := &PipeEndpoint{in: ab, out: ba, done: make(chan struct{})}
+	return a, b
+}
+
+// ReadPacket waits for the next packet from the other end. A packet longer
+// than b is truncated.
+func (p *PipeEndpoint) ReadPacket(b []byte) (int, error) {
+	select {
+	case pkt := <-p.in:
+		return copy(b, pkt), nil
+	case <-p.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// WritePacket queues a copy of pkt for the other end. Packets written after
+// the other end was closed are lost.
+func (p *PipeEndpoint) WritePacket(pkt []byte) error {
+	select {
+	case <-p.done:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case p.out <- append([]byte(nil), pkt...):
+	default:
+	}
+	return nil
+}
+
+// SharesHostPorts is false: nothing but tcplay is on the pipe.
+func (p *PipeEndpoint) SharesHostPorts() bool { return false }
+
+// Close closes this end. The other end stays open but receives nothing
+// more.
+func (p *PipeEndpoint) Close() error {
+	err := net.ErrClosed
+	p.once.Do(func() {
+		close(p.done)
+		err = nil
+	})
+	return err
+}
@@ -0,0 +1,87 @@
+package link
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// RawSocket is an IPPROTO_TCP raw socket. It receives a copy of every TCP
+// packet on the host, and sends packets with the IP header it is given
+// (IP_HDRINCL). It needs root or CAP_NET_RAW, and the kernel's TCP still
+// answers segments for ports it has no socket for with RSTs.
+type RawSocket struct {
+	conn *net.IPConn
+	raw  syscall.RawConn
+}
+
+// NewRawSocket opens the raw socket.
+func NewRawSocket() (*RawSocket, error) {
+	conn, err := net.ListenIP("ip4:tcp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %v", err)
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create socket: %v", err)
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set IP_HDRINCL: %v", err)
+	}
+
+	return &RawSocket{conn: conn, raw: raw}, nil
+}
+
+// ReadPacket reads the next TCP packet on the host.
+func (s *RawSocket) ReadPacket(b []byte) (int, error) {
+	var (
+		n       int
+		recvErr error
+	)
+	err := s.raw.Read(func(fd uintptr) bool {
+		n, _, recvErr = syscall.Recvfrom(int(fd), b, 0)
+		return recvErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return 0, net.ErrClosed
+	}
+	return n, recvErr
+}
+
+// WritePacket sends pkt to the destination in its IP header.
+func (s *RawSocket) WritePacket(pkt []byte) error {
+	if len(pkt) < 20 {
+		return fmt.Errorf("packet too short for IP header: %d bytes", len(pkt))
+	}
+	addr := &syscall.SockaddrInet4{Addr: [4]byte(pkt[16:20])}
+
+	var sendErr error
+	err := s.raw.Write(func(fd uintptr) bool {
+		sendErr = syscall.Sendto(int(fd), pkt, 0, addr)
+		return sendErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return net.ErrClosed
+	}
+	return sendErr
+}
+
+// SharesHostPorts is true: the kernel's TCP owns the ports tcplay does not
+// use.
+func (s *RawSocket) SharesHostPorts() bool { return true }
+
+// Close closes the socket.
+func (s *RawSocket) Close() error {
+	return s.conn.Close()
+}
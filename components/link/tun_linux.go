@@ -0,0 +1,103 @@
+package link
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunDevice = "/dev/net/tun"
+
+	// From linux/if_tun.h
+	tunSetIff = 0x400454ca
+	iffTun    = 0x0001
+	iffNoPi   = 0x1000
+)
+
+// ifReq is struct ifreq as TUNSETIFF reads it.
+type ifReq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// TUN is a Linux TUN device. The kernel routes packets for the device's
+// network to it instead of handling them, so tcplay acts as a separate
+// host behind it. The device has to be configured from outside, e.g.:
+//
+//	ip addr add 10.0.0.1/24 dev tcplay0
+//	ip link set tcplay0 up
+//
+// after which tcplay answers as 10.0.0.2.
+type TUN struct {
+	name string
+	file *os.File
+}
+
+// OpenTUN creates the TUN device name, or attaches to it if it exists and
+// is persistent. An empty name lets the kernel pick one; see Name.
+func OpenTUN(name string) (*TUN, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name %q too long", name)
+	}
+
+	fd, err := syscall.Open(tunDevice, syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", tunDevice, err)
+	}
+
+	var req ifReq
+	copy(req.Name[:], name)
+	req.Flags = iffTun | iffNoPi
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to create TUN device %q: %v", name, errno)
+	}
+
+	n := 0
+	for n < len(req.Name) && req.Name[n] != 0 {
+		n++
+	}
+
+	// A non-blocking descriptor goes through the runtime poller, so Close
+	// unblocks a pending read.
+	return &TUN{
+		name: string(req.Name[:n]),
+		file: os.NewFile(uintptr(fd), tunDevice),
+	}, nil
+}
+
+// Name returns the name of the network interface.
+func (t *TUN) Name() string {
+	return t.name
+}
+
+// ReadPacket reads the next packet the kernel routed to the device.
+func (t *TUN) ReadPacket(b []byte) (int, error) {
+	n, err := t.file.Read(b)
+	if errors.Is(err, os.ErrClosed) {
+		return 0, net.ErrClosed
+	}
+	return n, err
+}
+
+// WritePacket hands pkt to the kernel as if it arrived on the device.
+func (t *TUN) WritePacket(pkt []byte) error {
+	_, err := t.file.Write(pkt)
+	if errors.Is(err, os.ErrClosed) {
+		return net.ErrClosed
+	}
+	return err
+}
+
+// SharesHostPorts is false: every port on the device belongs to tcplay.
+func (t *TUN) SharesHostPorts() bool { return false }
+
+// Close removes the device unless it is persistent.
+func (t *TUN) Close() error {
+	return t.file.Close()
+}
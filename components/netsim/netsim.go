@@ -0,0 +1,319 @@
+// Package netsim simulates a link between two tcplay stacks in the same
+// process. Each direction has its own loss rate, latency, jitter, bandwidth,
+// reordering, duplication and corruption, and draws its random decisions
+// from a seeded source: the same seed gives the same loss, duplication,
+// reordering and corruption decisions for the same sequence of packets.
+//
+// Delays are measured on Config.Clock. With a clock.Fake, packets in flight
+// arrive as the test advances the clock, together with the timers of the
+// stacks on both ends. On the real clock, delivery depends on goroutine
+// scheduling, and so does the sequence of packets; a run only repeats if
+// the test advances a clock.Fake once both stacks are idle.
+//
+// Both ends satisfy core.LinkEndpoint:
+//
+//	a, b := netsim.Pipe(netsim.Config{Seed: 1, AtoB: netsim.LinkConfig{Loss: 0.01}})
+//	client := core.NewLinkDemux(a, [4]byte{10, 0, 0, 1})
+//	server := core.NewLinkDemux(b, [4]byte{10, 0, 0, 2})
+package netsim
+
+import (
+	"container/heap"
+	"math/rand"
+	"net"
+	"sync"
+	"tcplay/components/clock"
+	"time"
+)
+
+// receiveQueueLen is the number of delivered packets an endpoint buffers
+// before ReadPacket picks them up. Packets beyond it are dropped.
+const receiveQueueLen = 1024
+
+// LinkConfig describes one direction of the link.
+type LinkConfig struct {
+	Loss      float64       // probability that a packet is dropped
+	Latency   time.Duration // one-way propagation delay
+	Jitter    time.Duration // extra delay, uniform in [0, Jitter)
+	Bandwidth int           // bytes per second, 0 for unlimited
+	QueueLen  int           // packets waiting for the bandwidth limit, 0 for unlimited
+
+	// Reorder is the probability that a packet skips Latency and Jitter
+	// and overtakes the packets in flight ahead of it. It has no effect
+	// without a delay to skip.
+	Reorder float64
+
+	Duplicate float64 // probability that a packet is delivered twice
+	Corrupt   float64 // probability that one bit of a packet is flipped
+}
+
+// Config describes both directions of the link. Seed makes the random
+// decisions of a run repeatable for the same sequence of packets.
+type Config struct {
+	Seed  int64
+	AtoB  LinkConfig
+	BtoA  LinkConfig
+	Clock clock.Clock // clock.Real if nil
+}
+
+// Stats counts what happened to the packets sent in one direction.
+type Stats struct {
+	Sent       int // written by the sender
+	Lost       int // dropped by Loss or a full queue
+	Reordered  int
+	Duplicated int
+	Corrupted  int
+	Delivered  int // queued for the receiver, duplicates included
+}
+
+// Endpoint is one end of a simulated link.
+type Endpoint struct {
+	in   chan []byte
+	out  *direction
+	done chan struct{}
+	once sync.Once
+}
+
+// Pipe returns the two ends of a simulated link.
+func Pipe(cfg Config) (*Endpoint, *Endpoint) {
+	a := &Endpoint{in: make(chan []byte, receiveQueueLen), done: make(chan struct{})}
+	b := &Endpoint{in: make(chan []byte, receiveQueueLen), done: make(chan struct{})}
+
+	clk := cfg.Clock
+	if clk == nil {
+		clk = clock.Real
+	}
+	a.out = newDirection(clk, cfg.AtoB, cfg.Seed, a, b)
+	b.out = newDirection(clk, cfg.BtoA, cfg.Seed+1, b, a)
+	return a, b
+}
+
+// ReadPacket waits for the next packet from the other end. A packet longer
+// than b is truncated.
+func (e *Endpoint) ReadPacket(b []byte) (int, error) {
+	select {
+	case pkt := <-e.in:
+		return copy(b, pkt), nil
+	case <-e.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// WritePacket sends a copy of pkt towards the other end.
+func (e *Endpoint) WritePacket(pkt []byte) error {
+	select {
+	case <-e.done:
+		return net.ErrClosed
+	default:
+	}
+	e.out.send(append([]byte(nil), pkt...))
+	return nil
+}
+
+// SharesHostPorts is false: nothing but tcplay is on the link.
+func (e *Endpoint) SharesHostPorts() bool { return false }
+
+// Close closes this end. Packets in flight to it are lost.
+func (e *Endpoint) Close() error {
+	err := net.ErrClosed
+	e.once.Do(func() {
+		close(e.done)
+		err = nil
+	})
+	return err
+}
+
+// SetConfig changes the direction this end sends in. Packets already in
+// flight keep their fate.
+func (e *Endpoint) SetConfig(cfg LinkConfig) {
+	e.out.mu.Lock()
+	defer e.out.mu.Unlock()
+	e.out.cfg = cfg
+}
+
+// Stats returns the counters of the direction this end sends in.
+func (e *Endpoint) Stats() Stats {
+	e.out.mu.Lock()
+	defer e.out.mu.Unlock()
+	return e.out.stats
+}
+
+// direction carries packets from one endpoint to the other. Packets wait
+// in a queue ordered by arrival time, with a single timer for the first of
+// them; packets arriving at the same time keep the order they were sent in.
+type direction struct {
+	from, to *Endpoint
+	clock    clock.Clock
+
+	mu       sync.Mutex
+	cfg      LinkConfig
+	rand     *rand.Rand
+	stats    Stats
+	txQueue  []time.Time // departures of the packets held by the bandwidth limit
+	seq      uint64
+	inFlight packetQueue
+	timer    clock.Timer
+	timerAt  time.Time
+}
+
+func newDirection(clk clock.Clock, cfg LinkConfig, seed int64, from, to *Endpoint) *direction {
+	return &direction{
+		from:  from,
+		to:    to,
+		clock: clk,
+		cfg:   cfg,
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// send decides the fate of pkt and schedules its arrival.
+func (d *direction) send(pkt []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stats.Sent++
+	if d.chance(d.cfg.Loss) {
+		d.stats.Lost++
+		return
+	}
+
+	copies := 1
+	if d.chance(d.cfg.Duplicate) {
+		d.stats.Duplicated++
+		copies = 2
+	}
+
+	for i := 0; i < copies; i++ {
+		// Each copy is corrupted on its own, so all but the last are taken
+		// before pkt is touched
+		p := pkt
+		if i < copies-1 {
+			p = append([]byte(nil), pkt...)
+		}
+		if d.chance(d.cfg.Corrupt) && len(p) > 0 {
+			d.stats.Corrupted++
+			bit := d.rand.Intn(len(p) * 8)
+			p[bit/8] ^= 1 << (bit % 8)
+		}
+
+		at, ok := d.arrival(len(p))
+		if !ok {
+			d.stats.Lost++
+			continue
+		}
+
+		d.seq++
+		heap.Push(&d.inFlight, &packet{data: p, at: at, seq: d.seq})
+	}
+
+	d.deliverLocked()
+}
+
+// arrival returns when a packet of n bytes sent now arrives, or false if
+// the queue in front of the bandwidth limit is full. d.mu must be held.
+func (d *direction) arrival(n int) (time.Time, bool) {
+	now := d.clock.Now()
+	departure := now
+
+	if d.cfg.Bandwidth > 0 {
+		for len(d.txQueue) > 0 && !d.txQueue[0].After(now) {
+			d.txQueue = d.txQueue[1:]
+		}
+		if d.cfg.QueueLen > 0 && len(d.txQueue) >= d.cfg.QueueLen {
+			return time.Time{}, false
+		}
+		if len(d.txQueue) > 0 {
+			departure = d.txQueue[len(d.txQueue)-1]
+		}
+		departure = departure.Add(time.Duration(n) * time.Second / time.Duration(d.cfg.Bandwidth))
+		d.txQueue = append(d.txQueue, departure)
+	}
+
+	if d.chance(d.cfg.Reorder) && (d.cfg.Latency > 0 || d.cfg.Jitter > 0) {
+		d.stats.Reordered++
+		return departure, true
+	}
+
+	delay := d.cfg.Latency
+	if d.cfg.Jitter > 0 {
+		delay += time.Duration(d.rand.Int63n(int64(d.cfg.Jitter)))
+	}
+	return departure.Add(delay), true
+}
+
+// chance returns true with probability p. d.mu must be held.
+func (d *direction) chance(p float64) bool {
+	return p > 0 && d.rand.Float64() < p
+}
+
+// deliverLocked hands the packets that arrived by now to the receiving end
+// and sets the timer for the next one. d.mu must be held.
+func (d *direction) deliverLocked() {
+	select {
+	case <-d.from.done:
+		d.inFlight = nil
+	case <-d.to.done:
+		d.inFlight = nil
+	default:
+	}
+
+	now := d.clock.Now()
+	for d.inFlight.Len() > 0 && !d.inFlight[0].at.After(now) {
+		p := heap.Pop(&d.inFlight).(*packet)
+		select {
+		case d.to.in <- p.data:
+			d.stats.Delivered++
+		default:
+			d.stats.Lost++
+		}
+	}
+
+	if d.inFlight.Len() == 0 {
+		return
+	}
+	next := d.inFlight[0].at
+	if d.timer != nil {
+		if d.timerAt.Equal(next) {
+			return
+		}
+		d.timer.Stop()
+	}
+	d.timerAt = next
+	d.timer = d.clock.AfterFunc(next.Sub(now), d.onTimer)
+}
+
+func (d *direction) onTimer() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.timer = nil
+	d.deliverLocked()
+}
+
+type packet struct {
+	data []byte
+	at   time.Time
+	seq  uint64
+}
+
+// packetQueue is a min-heap of packets by arrival time, then send order.
+type packetQueue []*packet
+
+func (q packetQueue) Len() int { return len(q) }
+
+func (q packetQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+
+func (q packetQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *packetQueue) Push(x any) { *q = append(*q, x.(*packet)) }
+
+func (q *packetQueue) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return p
+}
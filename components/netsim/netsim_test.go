@@ -0,0 +1,76 @@
+package netsim
+
+import (
+	"bytes"
+	"math/bits"
+	"tcplay/components/clock"
+	"testing"
+	"time"
+)
+
+// receive returns the packets waiting at e.
+func receive(e *Endpoint) [][]byte {
+	var pkts [][]byte
+	buf := make([]byte, 1500)
+	for len(e.in) > 0 {
+		n, _ := e.ReadPacket(buf)
+		pkts = append(pkts, append([]byte(nil), buf[:n]...))
+	}
+	return pkts
+}
+
+func TestLatencyAndLoss(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	a, b := Pipe(Config{Seed: 1, Clock: clk, AtoB: LinkConfig{Loss: 0.5, Latency: 10 * time.Millisecond}})
+
+	for i := 0; i < 100; i++ {
+		a.WritePacket([]byte{byte(i)})
+	}
+	clk.Advance(9 * time.Millisecond)
+	if got := receive(b); len(got) != 0 {
+		t.Fatalf("%d packets arrived before the latency passed", len(got))
+	}
+	clk.Advance(time.Millisecond)
+	got := receive(b)
+
+	st := a.Stats()
+	if st.Sent != 100 || st.Lost+st.Delivered != 100 || st.Delivered != len(got) {
+		t.Fatalf("stats %+v for %d packets received", st, len(got))
+	}
+	if st.Lost < 30 || st.Lost > 70 {
+		t.Errorf("%d of 100 packets lost at a loss rate of 0.5", st.Lost)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i][0] <= got[i-1][0] {
+			t.Fatalf("packet %d arrived after %d", got[i][0], got[i-1][0])
+		}
+	}
+}
+
+func TestDuplicatesAreCorruptedIndependently(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	a, b := Pipe(Config{Seed: 1, Clock: clk, AtoB: LinkConfig{Duplicate: 1, Corrupt: 0.5}})
+
+	orig := bytes.Repeat([]byte{0x55}, 64)
+	for i := 0; i < 50; i++ {
+		a.WritePacket(orig)
+	}
+	got := receive(b)
+
+	flipped := 0
+	for _, p := range got {
+		for i := range p {
+			flipped += bits.OnesCount8(p[i] ^ orig[i])
+		}
+	}
+	st := a.Stats()
+	if len(got) != 100 || st.Duplicated != 50 {
+		t.Fatalf("%d packets received, stats %+v", len(got), st)
+	}
+	if flipped != st.Corrupted {
+		t.Errorf("%d bits flipped in the packets received, %d packets counted as corrupted", flipped, st.Corrupted)
+	}
+	if st.Corrupted == 0 {
+		t.Error("no packet corrupted")
+	}
+}
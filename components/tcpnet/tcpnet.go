@@ -0,0 +1,101 @@
+// Package tcpnet exposes the tcplay stack through the interfaces of package
+// net, so code written against net.Conn runs on it unchanged.
+package tcpnet
+
+import (
+	"fmt"
+	"net"
+	"tcplay/core"
+)
+
+// Dial connects to address over the tcplay stack. network must be "tcp" or
+// "tcp4"; only IPv4 is supported. The returned connection is a
+// *core.TCPConnection.
+func Dial(network, address string) (net.Conn, error) {
+	raddr, err := resolve(network, address, net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	c, err := core.CreateConnection(uint16(raddr.Port), [4]byte(raddr.IP.To4()))
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+	}
+
+	if err := c.Connect(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Source: c.LocalAddr(), Addr: raddr, Err: err}
+	}
+	return c, nil
+}
+
+// resolve resolves address to an IPv4 TCP address. An address without a
+// host gets the IP def.
+func resolve(network, address string, def net.IP) (*net.TCPAddr, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp4", address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil {
+		addr.IP = def
+	}
+	if addr.IP.To4() == nil {
+		return nil, fmt.Errorf("address %s is not IPv4", address)
+	}
+	return addr, nil
+}
+
+// Listener is a net.Listener backed by tcplay's passive open.
+type Listener struct {
+	l    *core.Listener
+	addr *net.TCPAddr
+}
+
+// Listen accepts connections on the port of address over the tcplay stack.
+// network must be "tcp" or "tcp4". The port is required, and connections
+// are accepted on every local address whatever the host part of address
+// is. The returned listener is a *Listener.
+func Listen(network, address string) (net.Listener, error) {
+	laddr, err := resolve(network, address, net.IPv4zero)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	if laddr.Port == 0 {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: laddr, Err: fmt.Errorf("port required")}
+	}
+
+	l, err := core.Listen(uint16(laddr.Port), core.DefaultBacklog)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: laddr, Err: err}
+	}
+	return &Listener{l: l, addr: laddr}, nil
+}
+
+// Accept waits for the next connection. The returned connection is a
+// *core.TCPConnection. Once the listener is closed it fails with an error
+// wrapping net.ErrClosed.
+func (ln *Listener) Accept() (net.Conn, error) {
+	c, err := ln.l.Accept()
+	if err != nil {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: ln.addr, Err: err}
+	}
+	return c, nil
+}
+
+// Close stops listening. Connections already accepted stay open.
+func (ln *Listener) Close() error {
+	if err := ln.l.Close(); err != nil {
+		return &net.OpError{Op: "close", Net: "tcp", Addr: ln.addr, Err: err}
+	}
+	return nil
+}
+
+// Addr returns the address the listener was created with.
+func (ln *Listener) Addr() net.Addr {
+	return ln.addr
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"tcplay/protocol"
+)
+
+// Close closes both directions of the connection. Data queued with
+// SendMessage is still delivered and followed by our FIN; data arriving
+// after Close is acknowledged and discarded. Close does not wait for the
+// peer, the close sequence runs on in the background; see RawClose.
+func (c *TCPConnection) Close() error {
+	log.Println("-----CLOSE CONN-----")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.readClosed {
+		return fmt.Errorf("connection already closed")
+	}
+	c.readClosed = true
+	c.receiveBuf = nil
+	c.notifyLocked()
+
+	switch c.state {
+	case CLOSED:
+		c.release()
+		return nil
+	case FIN_WAIT_2:
+		// CloseWrite got here first: nothing is left to send, and from now
+		// on the peer's FIN is only waited for up to the timeout
+		c.startTimeWait()
+		return nil
+	}
+	return c.shutdownWrite()
+}
+
+// CloseWrite closes the sending direction only (half-close): our FIN goes
+// out after the data already queued, and Read keeps returning what the peer
+// sends until its own FIN.
+func (c *TCPConnection) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shutdownWrite()
+}
+
+// RawClose closes the connection like Close and waits until our FIN is
+// acknowledged and the peer's FIN has arrived.
+func (c *TCPConnection) RawClose() error {
+	if err := c.Close(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.waitLocked(func() bool {
+		return c.state == TIME_WAIT || c.state == CLOSED
+	})
+	return c.err
+}
+
+// shutdownWrite queues our FIN. Before the handshake completed there is
+// nothing to close gracefully and the connection is simply dropped. c.mu
+// must be held.
+func (c *TCPConnection) shutdownWrite() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.finQueued {
+		return nil
+	}
+
+	switch c.state {
+	case CLOSED:
+		return fmt.Errorf("connection is not open")
+	case LISTEN, SYN_SENT:
+		return c.processEvent(EventClose)
+	}
+
+	// ESTABLISHED and SYN_RECEIVED go to FIN_WAIT_1, CLOSE_WAIT to LAST_ACK
+	if err := c.processEvent(EventClose); err != nil {
+		return err
+	}
+	c.finQueued = true
+	return c.output()
+}
+
+// sendFin sends our FIN right after the last byte of data. c.mu must be
+// held.
+func (c *TCPConnection) sendFin() error {
+	finHeader := &protocol.TCPHeader{
+		SourcePort:   c.srcPort,
+		DestPort:     c.destPort,
+		SeqNum:       c.sndNxt,
+		AckNum:       c.rcvNxt,
+		ControlFlags: protocol.FIN | protocol.ACK,
+		WindowSize:   c.advertisedWindow(),
+		HeaderLen:    5,
+	}
+
+	if err := c.sendReliable(finHeader, nil); err != nil {
+		return fmt.Errorf("failed to send FIN: %v", err)
+	}
+	c.finSent = true
+	c.finSeq = finHeader.SeqNum
+	return nil
+}
+
+// startTimeWait (re)starts the 2*MSL timer of TIME_WAIT. It also bounds
+// FIN_WAIT_2 after Close, when nobody would read what the peer still sends.
+func (c *TCPConnection) startTimeWait() {
+	c.arm(&c.timeWait, 2*c.cfg.MSL, c.onTimeWait)
+}
+
+func (c *TCPConnection) stopTimeWait() {
+	c.timeWait.stop()
+}
+
+func (c *TCPConnection) onTimeWait() {
+	if c.state == TIME_WAIT || c.state == FIN_WAIT_2 {
+		c.processEvent(EventTimeout)
+	}
+}
+
+// release stops every timer and gives the four-tuple back to the demux. It
+// runs when the connection reaches CLOSED, so after TIME_WAIT for an
+// active close. c.mu must be held.
+func (c *TCPConnection) release() {
+	c.stopRetransmitTimer()
+	c.stopPersistTimer()
+	c.stopPacingTimer()
+	c.stopDelayedAck()
+	c.stopTimeWait()
+	c.rtx.segments = nil
+	c.demux.unregister(c)
+}
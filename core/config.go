@@ -0,0 +1,98 @@
+package core
+
+import (
+	"tcplay/components/clock"
+	"tcplay/core/congestion"
+	"time"
+)
+
+// Config holds the tunables of a connection. Zero values are replaced with
+// the defaults from DefaultConfig.
+type Config struct {
+	// MaxRetries is how many times a segment is retransmitted before the
+	// connection gives up with a TimeoutError.
+	MaxRetries int
+
+	// MinRTO and MaxRTO bound the retransmission timeout (RFC 6298).
+	MinRTO time.Duration
+	MaxRTO time.Duration
+
+	// SendBufferSize is the number of bytes SendMessage may queue before it
+	// blocks, counting data that is sent but not yet acknowledged.
+	SendBufferSize int
+
+	// ReceiveBufferSize is the number of received bytes held for Read,
+	// which bounds the receive window. Beyond 64 KiB the window is only
+	// fully used if the peer supports window scaling.
+	ReceiveBufferSize int
+
+	// MSL is the maximum segment lifetime. A connection closed actively is
+	// held in TIME_WAIT for 2*MSL before its four-tuple can be reused.
+	MSL time.Duration
+
+	// DelayedAckTimeout is how long an ACK for received data may be held
+	// back in the hope of sending it along with data or the ACK of the
+	// next segment. RFC 1122 allows at most 500ms.
+	DelayedAckTimeout time.Duration
+
+	// CongestionControl names the congestion control algorithm, one of
+	// congestion.Reno, congestion.Cubic and congestion.BBR.
+	CongestionControl string
+
+	// Clock drives every timer of the connection. Tests with a simulated
+	// network use a clock.Fake to run without waiting.
+	Clock clock.Clock
+}
+
+// DefaultConfig returns the configuration new connections start with.
+func DefaultConfig() Config {
+	return Config{
+		MaxRetries: 8,
+		MinRTO:     1 * time.Second,
+		MaxRTO:     60 * time.Second,
+
+		SendBufferSize:    256 * 1024,
+		ReceiveBufferSize: 256 * 1024,
+
+		MSL: 30 * time.Second,
+
+		DelayedAckTimeout: 40 * time.Millisecond,
+
+		CongestionControl: congestion.Reno,
+
+		Clock: clock.Real,
+	}
+}
+
+// withDefaults fills zero fields of cfg from DefaultConfig.
+func (cfg Config) withDefaults() Config {
+	def := DefaultConfig()
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = def.MaxRetries
+	}
+	if cfg.MinRTO <= 0 {
+		cfg.MinRTO = def.MinRTO
+	}
+	if cfg.MaxRTO <= 0 {
+		cfg.MaxRTO = def.MaxRTO
+	}
+	if cfg.SendBufferSize <= 0 {
+		cfg.SendBufferSize = def.SendBufferSize
+	}
+	if cfg.ReceiveBufferSize <= 0 {
+		cfg.ReceiveBufferSize = def.ReceiveBufferSize
+	}
+	if cfg.MSL <= 0 {
+		cfg.MSL = def.MSL
+	}
+	if cfg.DelayedAckTimeout <= 0 {
+		cfg.DelayedAckTimeout = def.DelayedAckTimeout
+	}
+	if cfg.CongestionControl == "" {
+		cfg.CongestionControl = def.CongestionControl
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = def.Clock
+	}
+	return cfg
+}
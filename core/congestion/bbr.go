@@ -0,0 +1,197 @@
+package congestion
+
+import "time"
+
+// bbrMode is the phase of the BBR state machine.
+type bbrMode uint8
+
+const (
+	bbrStartup  bbrMode = iota // find the bottleneck bandwidth
+	bbrDrain                   // empty the queue Startup built
+	bbrProbeBW                 // cruise at the bandwidth, probing for more
+	bbrProbeRTT                // shrink the window to see the real RTT
+)
+
+const (
+	bbrHighGain      = 2.885 // 2/ln(2), doubles the rate every round
+	bbrCwndGain      = 2.0
+	bbrBwRounds      = 10 // rounds the bandwidth maximum is taken over
+	bbrFullBwRounds  = 3  // rounds without 25% growth that end Startup
+	bbrMinRTTWindow  = 10 * time.Second
+	bbrProbeRTTTime  = 200 * time.Millisecond
+	bbrMinCwndInSegs = 4
+)
+
+// bbrCycle is the pacing gain of each round in ProbeBW.
+var bbrCycle = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// bbrController is an experimental model-based controller after BBR
+// (draft-cardwell-iccrg-bbr-congestion-control). Instead of reacting to
+// losses it estimates the bottleneck bandwidth and the minimum RTT, paces
+// at the bandwidth and keeps about two bandwidth-delay products in flight.
+//
+// It is much simplified: a round is one minimum RTT of wall time, and the
+// delivery rate is what was acknowledged in it, app-limited or not.
+type bbrController struct {
+	mss  uint32
+	mode bbrMode
+	cwnd uint32
+
+	delivered      uint64 // bytes acknowledged so far
+	roundStart     time.Time
+	roundDelivered uint64
+	bwSamples      []float64 // delivery rate of the last rounds, bytes/s
+	btlBw          float64
+
+	minRTT      time.Duration
+	minRTTStamp time.Time
+
+	fullBw       float64
+	fullBwRounds int
+	cycle        int
+	probeRTTEnd  time.Time
+	priorCwnd    uint32 // window to return to after ProbeRTT or recovery
+}
+
+// NewBBR returns a BBR-style controller.
+func NewBBR(mss uint32) Controller {
+	return &bbrController{
+		mss:  mss,
+		cwnd: initialWindow(mss),
+	}
+}
+
+func (b *bbrController) Cwnd() uint32 {
+	if b.mode == bbrProbeRTT {
+		return bbrMinCwndInSegs * b.mss
+	}
+	return b.cwnd
+}
+
+func (b *bbrController) PacingRate() uint64 {
+	return uint64(b.pacingGain() * b.btlBw)
+}
+
+func (b *bbrController) pacingGain() float64 {
+	switch b.mode {
+	case bbrStartup:
+		return bbrHighGain
+	case bbrDrain:
+		return 1 / bbrHighGain
+	case bbrProbeBW:
+		return bbrCycle[b.cycle]
+	}
+	return 1
+}
+
+// bdp returns the bandwidth-delay product, or 0 while the model is empty.
+func (b *bbrController) bdp() uint32 {
+	return uint32(min(b.btlBw*b.minRTT.Seconds(), maxCwnd))
+}
+
+func (b *bbrController) OnAck(acked, flight uint32, now time.Time) {
+	b.delivered += uint64(acked)
+	if b.roundStart.IsZero() {
+		b.roundStart = now
+		b.roundDelivered = b.delivered - uint64(acked)
+	}
+	if b.minRTT > 0 && now.Sub(b.roundStart) >= b.minRTT {
+		b.endRound(now)
+	}
+
+	switch b.mode {
+	case bbrDrain:
+		if flight <= b.bdp() {
+			b.mode = bbrProbeBW
+			b.cycle = 0
+		}
+	case bbrProbeRTT:
+		if !now.Before(b.probeRTTEnd) {
+			b.minRTTStamp = now
+			b.cwnd = max(b.cwnd, b.priorCwnd)
+			b.mode = bbrProbeBW
+			if b.fullBwRounds < bbrFullBwRounds {
+				b.mode = bbrStartup
+			}
+		}
+	}
+
+	// Grow towards the target, by what was delivered so the window never
+	// runs ahead of the ACK clock
+	gain := bbrCwndGain
+	if b.mode == bbrStartup {
+		gain = bbrHighGain
+	}
+	target := uint32(gain * float64(b.bdp()))
+	if target == 0 || b.cwnd < target {
+		b.cwnd += acked
+		if target > 0 {
+			b.cwnd = min(b.cwnd, target)
+		}
+	} else {
+		b.cwnd = target
+	}
+	b.cwnd = min(max(b.cwnd, bbrMinCwndInSegs*b.mss), maxCwnd)
+}
+
+// endRound takes a delivery rate sample and moves the state machine on.
+func (b *bbrController) endRound(now time.Time) {
+	elapsed := now.Sub(b.roundStart).Seconds()
+	rate := float64(b.delivered-b.roundDelivered) / elapsed
+	b.roundStart = now
+	b.roundDelivered = b.delivered
+
+	b.bwSamples = append(b.bwSamples, rate)
+	if len(b.bwSamples) > bbrBwRounds {
+		b.bwSamples = b.bwSamples[1:]
+	}
+	b.btlBw = 0
+	for _, s := range b.bwSamples {
+		b.btlBw = max(b.btlBw, s)
+	}
+
+	switch b.mode {
+	case bbrStartup:
+		if b.btlBw >= 1.25*b.fullBw {
+			b.fullBw = b.btlBw
+			b.fullBwRounds = 0
+		} else if b.fullBwRounds++; b.fullBwRounds >= bbrFullBwRounds {
+			b.mode = bbrDrain
+		}
+	case bbrProbeBW:
+		b.cycle = (b.cycle + 1) % len(bbrCycle)
+	}
+}
+
+func (b *bbrController) OnRTTSample(rtt time.Duration, now time.Time) {
+	expired := !b.minRTTStamp.IsZero() && now.Sub(b.minRTTStamp) > bbrMinRTTWindow
+	if b.minRTT == 0 || rtt <= b.minRTT || expired {
+		b.minRTT = rtt
+		b.minRTTStamp = now
+	}
+	if expired && b.mode != bbrProbeRTT {
+		b.priorCwnd = b.cwnd
+		b.mode = bbrProbeRTT
+		b.probeRTTEnd = now.Add(bbrProbeRTTTime)
+	}
+}
+
+// OnLoss does not touch the model, but holds the window at what is in
+// flight until recovery ends (packet conservation).
+func (b *bbrController) OnLoss(flight uint32, now time.Time) {
+	b.priorCwnd = b.cwnd
+	b.cwnd = max(flight, bbrMinCwndInSegs*b.mss)
+}
+
+func (b *bbrController) OnRecovered(flight uint32, now time.Time) {
+	b.cwnd = max(b.cwnd, b.priorCwnd)
+}
+
+// OnRTO restarts from one segment. The model is kept, so the window grows
+// back to its target with every ACK.
+func (b *bbrController) OnRTO(flight uint32, first bool, now time.Time) {
+	if first {
+		b.priorCwnd = b.cwnd
+	}
+	b.cwnd = b.mss
+}
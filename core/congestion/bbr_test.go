@@ -0,0 +1,124 @@
+package congestion
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// deliver acknowledges a segment at a time at rate bytes per second for d,
+// with flight bytes in flight and an RTT sample of rtt on every ACK. It
+// returns the time at the end.
+func deliver(b *bbrController, now time.Time, d time.Duration, rate float64, rtt time.Duration, flight uint32) time.Time {
+	gap := time.Duration(float64(mss) / rate * float64(time.Second))
+	for end := now.Add(d); now.Before(end); now = now.Add(gap) {
+		b.OnRTTSample(rtt, now)
+		b.OnAck(mss, flight, now)
+	}
+	return now
+}
+
+// TestBBRModes takes the controller through Startup, Drain, ProbeBW and
+// ProbeRTT on a path of 1 MB/s and 100ms.
+func TestBBRModes(t *testing.T) {
+	const (
+		rate = 1e6
+		rtt  = 100 * time.Millisecond
+		bdp  = 100000
+	)
+	now := time.Unix(0, 0)
+	b := NewBBR(mss).(*bbrController)
+	if b.mode != bbrStartup || b.PacingRate() != 0 {
+		t.Fatalf("mode %d, pacing rate %d before any ACK", b.mode, b.PacingRate())
+	}
+
+	// Startup grows the window by what is delivered while the model is
+	// empty, and ends after three rounds without 25% more bandwidth
+	now = deliver(b, now, 50*time.Millisecond, rate, rtt, 2*bdp)
+	if b.mode != bbrStartup || b.Cwnd() != initialWindow(mss)+50*mss {
+		t.Fatalf("mode %d, cwnd %d half a round into Startup", b.mode, b.Cwnd())
+	}
+	now = deliver(b, now, 550*time.Millisecond, rate, rtt, 2*bdp)
+	if b.mode != bbrDrain {
+		t.Fatalf("mode %d after six rounds at the same bandwidth, want Drain", b.mode)
+	}
+	if math.Abs(b.btlBw-rate) > 0.02*rate || b.minRTT != rtt {
+		t.Fatalf("model: %.0f bytes/s, %v; want %.0f bytes/s, %v", b.btlBw, b.minRTT, float64(rate), rtt)
+	}
+	if got, want := float64(b.PacingRate()), b.btlBw/bbrHighGain; math.Abs(got-want) > 1 {
+		t.Errorf("pacing rate %.0f in Drain, want %.0f", got, want)
+	}
+
+	// Drain ends once the queue is gone
+	now = deliver(b, now, 5*time.Millisecond, rate, rtt, 2*bdp)
+	if b.mode != bbrDrain {
+		t.Fatalf("mode %d with two BDPs in flight, want Drain", b.mode)
+	}
+	now = deliver(b, now, 5*time.Millisecond, rate, rtt, bdp)
+	if b.mode != bbrProbeBW || b.cycle != 0 {
+		t.Fatalf("mode %d, cycle %d with a BDP in flight, want ProbeBW at 0", b.mode, b.cycle)
+	}
+
+	// ProbeBW cycles through the pacing gains, one round each, and keeps
+	// two BDPs in flight
+	cycle := b.cycle
+	now = deliver(b, now, rtt, rate, rtt, bdp)
+	if b.cycle != cycle+1 {
+		t.Fatalf("cycle %d after a round, want %d", b.cycle, cycle+1)
+	}
+	if got, want := float64(b.PacingRate()), bbrCycle[b.cycle]*b.btlBw; math.Abs(got-want) > 1 {
+		t.Errorf("pacing rate %.0f in cycle %d, want %.0f", got, b.cycle, want)
+	}
+	now = deliver(b, now, 2*time.Second, rate, rtt, bdp)
+	if got := b.Cwnd(); got != 2*bdp {
+		t.Fatalf("cwnd %d in ProbeBW, want %d", got, 2*bdp)
+	}
+
+	// Ten seconds without an RTT as low as the minimum: ProbeRTT shrinks the
+	// window for 200ms, then ProbeBW resumes with the window it had
+	now = deliver(b, now, 10*time.Second+50*time.Millisecond, rate, rtt+10*time.Millisecond, bdp)
+	if b.mode != bbrProbeRTT || b.Cwnd() != bbrMinCwndInSegs*mss {
+		t.Fatalf("mode %d, cwnd %d after the minimum RTT expired, want ProbeRTT", b.mode, b.Cwnd())
+	}
+	if b.minRTT != rtt+10*time.Millisecond {
+		t.Errorf("minimum RTT %v, want the fresh sample %v", b.minRTT, rtt+10*time.Millisecond)
+	}
+	now = deliver(b, now, bbrProbeRTTTime, rate, rtt+10*time.Millisecond, bdp)
+	if b.mode != bbrProbeBW || b.Cwnd() < 2*bdp {
+		t.Errorf("mode %d, cwnd %d after ProbeRTT, want ProbeBW with at least %d", b.mode, b.Cwnd(), 2*bdp)
+	}
+}
+
+func TestBBRLossAndRTO(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBBR(mss).(*bbrController)
+	now = deliver(b, now, time.Second, 1e6, 100*time.Millisecond, 100000)
+	cwnd, bw := b.Cwnd(), b.btlBw
+
+	// A loss holds the window at what is in flight, at least four
+	// segments, until recovery ends
+	for _, flight := range []uint32{30 * mss, mss} {
+		b.OnLoss(flight, now)
+		if got, want := b.Cwnd(), max(flight, bbrMinCwndInSegs*mss); got != want {
+			t.Fatalf("cwnd %d in recovery with %d bytes in flight, want %d", got, flight, want)
+		}
+		b.OnRecovered(flight, now)
+		if got := b.Cwnd(); got != cwnd {
+			t.Fatalf("cwnd %d after recovery, want %d", got, cwnd)
+		}
+	}
+
+	// An RTO restarts from one segment but keeps the model
+	b.OnRTO(cwnd, true, now)
+	if got := b.Cwnd(); got != mss || b.btlBw != bw {
+		t.Fatalf("cwnd %d, bandwidth %.0f after an RTO; want %d, %.0f", got, b.btlBw, mss, bw)
+	}
+	b.OnRTO(mss, false, now)
+	if b.priorCwnd != cwnd {
+		t.Errorf("window to return to %d after a second RTO, want %d", b.priorCwnd, cwnd)
+	}
+	b.OnAck(mss, mss, now)
+	if got := b.Cwnd(); got != bbrMinCwndInSegs*mss {
+		t.Errorf("cwnd %d after the first ACK past an RTO, want %d", got, bbrMinCwndInSegs*mss)
+	}
+}
@@ -0,0 +1,73 @@
+// Package congestion implements the congestion control algorithms a
+// connection can use: Reno (RFC 5681), CUBIC (RFC 9438) and an
+// experimental model-based controller in the style of BBR.
+//
+// Loss detection and retransmission stay with the connection. It tells the
+// controller what happened to its data and keeps no more than Cwnd bytes in
+// flight, sent no faster than PacingRate.
+package congestion
+
+import (
+	"fmt"
+	"time"
+)
+
+// Controller is a congestion control algorithm. All sizes are in bytes.
+type Controller interface {
+	// Cwnd returns the congestion window.
+	Cwnd() uint32
+
+	// PacingRate returns the rate, in bytes per second, to spread segments
+	// out at, or 0 to send them as fast as the window allows.
+	PacingRate() uint64
+
+	// OnAck is called for an ACK that acknowledges acked new bytes outside
+	// of fast recovery, leaving flight bytes in flight.
+	OnAck(acked, flight uint32, now time.Time)
+
+	// OnRTTSample reports a round-trip time measurement.
+	OnRTTSample(rtt time.Duration, now time.Time)
+
+	// OnLoss is called when duplicate ACKs showed a loss and fast recovery
+	// starts, with flight bytes in flight.
+	OnLoss(flight uint32, now time.Time)
+
+	// OnRecovered is called when fast recovery ends, with flight bytes in
+	// flight.
+	OnRecovered(flight uint32, now time.Time)
+
+	// OnRTO is called when the retransmission timer expires. first is false
+	// if the same segment timed out before.
+	OnRTO(flight uint32, first bool, now time.Time)
+}
+
+// Names of the algorithms New knows.
+const (
+	Reno  = "reno"
+	Cubic = "cubic"
+	BBR   = "bbr"
+)
+
+// New returns a controller running the named algorithm for segments of
+// mss bytes.
+func New(name string, mss uint32) (Controller, error) {
+	switch name {
+	case Reno:
+		return NewReno(mss), nil
+	case Cubic:
+		return NewCubic(mss), nil
+	case BBR:
+		return NewBBR(mss), nil
+	}
+	return nil, fmt.Errorf("unknown congestion control algorithm %q", name)
+}
+
+// maxCwnd bounds every congestion window. ssthresh starts there, which is
+// as good as arbitrarily high.
+const maxCwnd = 1 << 30
+
+// initialWindow is the window a connection starts with (RFC 5681, section
+// 3.1).
+func initialWindow(mss uint32) uint32 {
+	return min(4*mss, max(2*mss, 4380))
+}
@@ -0,0 +1,20 @@
+package congestion
+
+import "testing"
+
+const mss = 1000
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{Reno, Cubic, BBR} {
+		c, err := New(name, mss)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Cwnd(); got != 4*mss {
+			t.Errorf("%s starts with a window of %d bytes, want %d", name, got, 4*mss)
+		}
+	}
+	if _, err := New("vegas", mss); err == nil {
+		t.Error("New accepted an unknown algorithm")
+	}
+}
@@ -0,0 +1,127 @@
+package congestion
+
+import (
+	"math"
+	"time"
+)
+
+// CUBIC constants (RFC 9438, section 4).
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// cubicController grows the window along a cubic function of the time
+// since the last loss, centred on the window the loss happened at (RFC
+// 9438). Windows are kept in segments.
+type cubicController struct {
+	mss      float64
+	cwnd     float64
+	ssthresh float64
+
+	wMax       float64   // window before the last reduction
+	k          float64   // seconds until the cubic function reaches wMax again
+	epochStart time.Time // start of the current congestion avoidance epoch
+	wEst       float64   // the window Reno would have (section 4.3)
+	srtt       time.Duration
+}
+
+// NewCubic returns a CUBIC controller.
+func NewCubic(mss uint32) Controller {
+	return &cubicController{
+		mss:      float64(mss),
+		cwnd:     float64(initialWindow(mss)) / float64(mss),
+		ssthresh: maxCwnd / float64(mss),
+	}
+}
+
+func (c *cubicController) Cwnd() uint32 {
+	return uint32(min(c.cwnd*c.mss, maxCwnd))
+}
+
+func (c *cubicController) PacingRate() uint64 { return 0 }
+
+func (c *cubicController) OnAck(acked, flight uint32, now time.Time) {
+	segs := float64(acked) / c.mss
+	if c.cwnd < c.ssthresh {
+		// Slow start
+		c.cwnd += min(segs, 1)
+		return
+	}
+
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		if c.cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - c.cwnd) / cubicC)
+		} else {
+			c.k = 0
+			c.wMax = c.cwnd
+		}
+		c.wEst = c.cwnd
+	}
+
+	// Section 4.2: aim at where the cubic function is one RTT from now,
+	// but grow by at most half the window per RTT
+	t := now.Sub(c.epochStart).Seconds()
+	target := c.wCubic(t + c.srtt.Seconds())
+	target = max(c.cwnd, min(target, 1.5*c.cwnd))
+
+	// Section 4.3: never grow slower than Reno would
+	alpha := 3 * (1 - cubicBeta) / (1 + cubicBeta)
+	if c.wEst >= c.wMax {
+		alpha = 1
+	}
+	c.wEst += alpha * segs / c.cwnd
+
+	if c.wCubic(t) < c.wEst {
+		c.cwnd = c.wEst
+	} else {
+		c.cwnd += (target - c.cwnd) / c.cwnd * segs
+	}
+}
+
+// wCubic is W_cubic(t), equation 1.
+func (c *cubicController) wCubic(t float64) float64 {
+	d := t - c.k
+	return cubicC*d*d*d + c.wMax
+}
+
+func (c *cubicController) OnRTTSample(rtt time.Duration, now time.Time) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+}
+
+// OnLoss reduces the window by beta and remembers where the loss
+// happened (section 4.6), lower still if it happened before the last one
+// was reached again (fast convergence, section 4.7).
+func (c *cubicController) OnLoss(flight uint32, now time.Time) {
+	c.reduce()
+	c.cwnd = c.ssthresh
+}
+
+func (c *cubicController) reduce() {
+	if c.cwnd < c.wMax {
+		c.wMax = c.cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = c.cwnd
+	}
+	c.ssthresh = max(c.cwnd*cubicBeta, 2)
+	c.epochStart = time.Time{}
+}
+
+func (c *cubicController) OnRecovered(flight uint32, now time.Time) {
+	c.cwnd = c.ssthresh
+}
+
+// OnRTO reduces as for a loss the first time and restarts from one
+// segment (section 4.8).
+func (c *cubicController) OnRTO(flight uint32, first bool, now time.Time) {
+	if first {
+		c.reduce()
+	}
+	c.cwnd = 1
+	c.epochStart = time.Time{}
+}
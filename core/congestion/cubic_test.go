@@ -0,0 +1,114 @@
+package congestion
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCubicSlowStart(t *testing.T) {
+	var now time.Time
+	c := NewCubic(mss)
+	for i := 0; i < 4; i++ {
+		c.OnAck(mss, 4*mss, now)
+	}
+	c.OnAck(3*mss, 8*mss, now)
+	if got := c.Cwnd(); got != 9*mss {
+		t.Errorf("cwnd %d after five ACKs in slow start, want %d", got, 9*mss)
+	}
+}
+
+func TestCubicLoss(t *testing.T) {
+	var now time.Time
+	c := NewCubic(mss).(*cubicController)
+	c.cwnd = 100
+
+	c.OnLoss(100*mss, now)
+	if got := c.Cwnd(); got != 70*mss || c.wMax != 100 {
+		t.Fatalf("cwnd %d, W_max %v after a loss; want %d and 100", got, c.wMax, 70*mss)
+	}
+
+	// A loss before W_max is reached again lowers W_max further (fast
+	// convergence, RFC 9438, section 4.7)
+	c.cwnd = 90
+	c.OnLoss(90*mss, now)
+	if c.wMax != 90*(1+cubicBeta)/2 || math.Abs(c.cwnd-63) > 1e-9 {
+		t.Fatalf("cwnd %v, W_max %v segments after a second loss; want 63 and %v", c.cwnd, c.wMax, 90*(1+cubicBeta)/2)
+	}
+
+	c.cwnd = 40
+	c.OnRecovered(40*mss, now)
+	if c.cwnd != c.ssthresh {
+		t.Errorf("cwnd %v segments after recovery, want ssthresh %v", c.cwnd, c.ssthresh)
+	}
+}
+
+func TestCubicRTO(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewCubic(mss).(*cubicController)
+	c.cwnd = 100
+
+	c.OnRTO(100*mss, true, now)
+	if got := c.Cwnd(); got != mss || c.ssthresh != 70 || c.wMax != 100 {
+		t.Fatalf("cwnd %d, ssthresh %v, W_max %v after an RTO", got, c.ssthresh, c.wMax)
+	}
+	c.OnRTO(mss, false, now)
+	if c.ssthresh != 70 {
+		t.Fatalf("ssthresh %v after a second RTO of the same segment, want 70", c.ssthresh)
+	}
+
+	// Slow start up to ssthresh, then the cubic function takes over
+	for c.cwnd < c.ssthresh {
+		c.OnAck(mss, c.Cwnd(), now)
+	}
+	if !c.epochStart.IsZero() {
+		t.Error("congestion avoidance epoch started in slow start")
+	}
+	c.OnAck(mss, c.Cwnd(), now)
+	if c.epochStart.IsZero() {
+		t.Error("no congestion avoidance epoch after slow start")
+	}
+}
+
+// TestCubicCurve runs rounds of ACKs after a loss at a window of 1000
+// segments, where CUBIC is well past the Reno-friendly region, and checks
+// that the window follows W_cubic(t) = C*(t-K)^3 + W_max (RFC 9438,
+// section 4.2): concave up to W_max at t = K, convex beyond it.
+func TestCubicCurve(t *testing.T) {
+	const rtt = 100 * time.Millisecond
+	now := time.Unix(0, 0)
+	c := NewCubic(mss).(*cubicController)
+	c.OnRTTSample(rtt, now)
+	c.cwnd = 1000
+	c.OnLoss(1000*mss, now)
+
+	wantK := math.Cbrt(1000 * (1 - cubicBeta) / cubicC)
+	var at []float64 // cwnd at the start of each round
+	for round := 0; round < 150; round++ {
+		at = append(at, c.cwnd)
+		n := int(c.cwnd)
+		for i := 0; i < n; i++ {
+			c.OnAck(mss, c.Cwnd(), now)
+			now = now.Add(rtt / time.Duration(n))
+		}
+	}
+	if math.Abs(c.k-wantK) > 1e-9 {
+		t.Fatalf("K = %v, want %v", c.k, wantK)
+	}
+
+	// The window keeps within a segment of W_cubic(t)
+	for round, w := range at {
+		tm := float64(round) * rtt.Seconds()
+		if want := c.wCubic(tm); math.Abs(w-want) > 1 {
+			t.Errorf("t = %.1fs: cwnd %.1f segments, W_cubic %.1f", tm, w, want)
+		}
+	}
+
+	k := int(wantK / rtt.Seconds())
+	if plateau := at[k+1] - at[k]; plateau > 1 {
+		t.Errorf("window grew by %.1f segments per round at t = K, want a plateau", plateau)
+	}
+	if at[5]-at[4] <= at[k]-at[k-1] || at[149]-at[148] <= at[k+1]-at[k] {
+		t.Errorf("window does not grow concave before K and convex after: %v", at)
+	}
+}
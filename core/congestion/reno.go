@@ -0,0 +1,56 @@
+package congestion
+
+import "time"
+
+// renoController is slow start and congestion avoidance as in RFC 5681.
+type renoController struct {
+	mss      uint32
+	cwnd     uint32
+	ssthresh uint32
+}
+
+// NewReno returns a Reno controller.
+func NewReno(mss uint32) Controller {
+	return &renoController{
+		mss:      mss,
+		cwnd:     initialWindow(mss),
+		ssthresh: maxCwnd,
+	}
+}
+
+func (r *renoController) Cwnd() uint32       { return r.cwnd }
+func (r *renoController) PacingRate() uint64 { return 0 }
+
+func (r *renoController) OnAck(acked, flight uint32, now time.Time) {
+	if r.cwnd < r.ssthresh {
+		// Slow start
+		r.cwnd += min(acked, r.mss)
+	} else {
+		// Congestion avoidance: about one segment per RTT
+		r.cwnd += max(r.mss*r.mss/r.cwnd, 1)
+	}
+	r.cwnd = min(r.cwnd, maxCwnd)
+}
+
+func (r *renoController) OnRTTSample(rtt time.Duration, now time.Time) {}
+
+// OnLoss halves the window (RFC 5681, section 3.2, step 2).
+func (r *renoController) OnLoss(flight uint32, now time.Time) {
+	r.ssthresh = max(flight/2, 2*r.mss)
+	r.cwnd = r.ssthresh
+}
+
+// OnRecovered deflates the window to what is in flight plus a segment, so
+// that leaving recovery causes no burst (RFC 6582, section 3.2, step 3).
+func (r *renoController) OnRecovered(flight uint32, now time.Time) {
+	r.cwnd = min(r.ssthresh, max(flight, r.mss)+r.mss)
+}
+
+// OnRTO restarts slow start from one segment (RFC 5681, section 3.1).
+// ssthresh is only lowered the first time a segment times out.
+func (r *renoController) OnRTO(flight uint32, first bool, now time.Time) {
+	if first {
+		r.ssthresh = max(flight/2, 2*r.mss)
+	}
+	r.cwnd = r.mss
+}
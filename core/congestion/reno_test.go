@@ -0,0 +1,42 @@
+package congestion
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenoSlowStartLossAndRTO(t *testing.T) {
+	var now time.Time
+	r := NewReno(mss)
+
+	// Slow start: one segment per ACK, however much it acknowledges
+	r.OnAck(mss, 4*mss, now)
+	r.OnAck(3*mss, 4*mss, now)
+	if got := r.Cwnd(); got != 6*mss {
+		t.Fatalf("cwnd %d after two ACKs in slow start, want %d", got, 6*mss)
+	}
+
+	r.OnLoss(6*mss, now)
+	if got := r.Cwnd(); got != 3*mss {
+		t.Fatalf("cwnd %d after a loss, want %d", got, 3*mss)
+	}
+
+	// Congestion avoidance: about a segment per window of ACKs
+	for i := 0; i < 3; i++ {
+		r.OnAck(mss, 3*mss, now)
+	}
+	if got := r.Cwnd(); got < 3*mss+mss*9/10 || got > 4*mss {
+		t.Fatalf("cwnd %d after a window of ACKs in congestion avoidance", got)
+	}
+
+	r.OnRTO(8*mss, true, now)
+	if got := r.Cwnd(); got != mss {
+		t.Fatalf("cwnd %d after an RTO, want %d", got, mss)
+	}
+	r.OnRTO(mss, false, now)
+	r.OnAck(mss, mss, now)
+	r.OnAck(mss, mss, now)
+	if got := r.Cwnd(); got != 3*mss {
+		t.Errorf("cwnd %d in slow start after repeated RTOs, want %d: ssthresh was lowered again", got, 3*mss)
+	}
+}
@@ -3,253 +3,274 @@ package core
 import (
 	"fmt"
 	"log"
-	"syscall"
-	"tcplay/components/waiter"
-	"tcplay/core/ip"
+	"sync"
+	"tcplay/core/congestion"
 	"tcplay/protocol"
 	"time"
+)
+
+const (
+	// defaultMSS is the segment size announced in our SYN: an Ethernet MTU
+	// minus the IP and TCP headers.
+	defaultMSS = 1460
 
-	"math/rand"
+	// peerDefaultMSS is assumed when the peer's SYN has no MSS option (RFC
+	// 9293, section 3.7.1).
+	peerDefaultMSS = 536
 )
 
 type TCPConnection struct {
+	mu sync.Mutex
+
 	srcPort    uint16
 	destPort   uint16
 	srcIP      [4]byte
 	destIP     [4]byte
-	seqNum     uint32
-	ackNum     uint32
-	state      uint8
-	rawSocket  int
-	receiveBuf []byte
-	sendBuf    []byte
+	state      State
 	maxSegSize uint16
-	ipHeader   ip.IPHeader
+
+	// Send sequence space (RFC 9293, section 3.3.1). sendBuf holds the
+	// bytes from sndUna on: sent but unacknowledged data first, then data
+	// not sent yet.
+	iss     uint32 // initial send sequence number
+	sndUna  uint32 // oldest unacknowledged sequence number
+	sndNxt  uint32 // next sequence number to send
+	sndSml  uint32 // end of the last segment shorter than MSS sent
+	sendBuf []byte
+
+	// Send window: what the peer advertised last and the segment it came
+	// with (SND.WND, SND.WL1, SND.WL2).
+	sndWnd    uint32
+	sndWl1    uint32
+	sndWl2    uint32
+	maxSndWnd uint32 // largest window the peer ever offered
+
+	// Window scaling (RFC 7323): the shifts of the peer's window and of
+	// ours, both zero unless both SYNs carried the option.
+	wscaleOK  bool
+	sndWscale uint8
+	rcvWscale uint8
+	persist   connTimer
+
+	// Receive sequence space. receiveBuf holds in-order data that Read has
+	// not consumed yet, ooo the data that arrived ahead of a gap.
+	irs         uint32 // initial receive sequence number
+	rcvNxt      uint32 // next sequence number expected
+	rcvAdv      uint32 // right edge of the window advertised last
+	lastAckSent uint32 // acknowledgment number sent last (Last.ACK.sent)
+	delack      delayedAck
+	receiveBuf  []byte
+	ooo         reassembly
+	finReceived bool // the peer's FIN was consumed, Read returns io.EOF
+
+	// The peer's FIN arrived ahead of some data and waits for it.
+	rcvFinPending bool
+	rcvFinSeq     uint32
+
+	// Close and CloseWrite queue our FIN behind the data not sent yet; once
+	// it is sent, finSeq is its sequence number.
+	finQueued  bool
+	finSent    bool
+	finSeq     uint32
+	readClosed bool // Close was called, received data is discarded
+	timeWait   connTimer
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	// Small segments are held back by Nagle's algorithm unless noDelay is
+	// set, and all of them while cork is, see holdBack.
+	noDelay bool
+	cork    bool
+
+	// Challenge ACKs sent in the current one second interval
+	challengeAcks  int
+	challengeStart time.Time
+
+	cfg           Config
+	rtx           *retransmitQueue
+	sackPermitted bool // both sides sent SACK-Permitted
+	ts            timestamps
+	cc            congestion.Controller
+	recovery      recovery
+	paceNext      time.Time // when the pacing rate admits the next segment
+	pacer         connTimer
+	stats         Stats
+
+	// err is the reason the connection failed, reported to every caller
+	// blocked on it.
+	err error
+
+	// changed is closed and replaced whenever the state changes, to wake up
+	// goroutines waiting in waitLocked.
+	changed chan struct{}
+
+	// The demux owns the link endpoint and feeds segments for this connection's
+	// four-tuple through inbound.
+	demux   *Demux
+	inbound chan *segment
 }
 
-const (
-	CLOSED      = 0
-	SYN_SENT    = 1
-	ESTABLISHED = 2
-)
+func newConnection(srcIP [4]byte, srcPort uint16, destIP [4]byte, destPort uint16, cfg Config) *TCPConnection {
+	cfg = cfg.withDefaults()
+	iss := generateRandomSeqNum()
+	c := &TCPConnection{
+		srcPort:    srcPort,
+		destPort:   destPort,
+		srcIP:      srcIP,
+		destIP:     destIP,
+		iss:        iss,
+		sndUna:     iss,
+		sndNxt:     iss,
+		sndSml:     iss,
+		state:      CLOSED,
+		maxSegSize: defaultMSS,
+		cfg:        cfg,
+		rtx:        &retransmitQueue{rto: newRTOEstimator(cfg)},
+		ts:         newTimestamps(),
+		delack:     delayedAck{quick: quickAckSegments},
+		changed:    make(chan struct{}),
+	}
+	c.initCongestion()
+	return c
+}
 
+// CreateConnection registers a new connection to destIP:destPort with the
+// default demux.
 func CreateConnection(destPort uint16, destIP [4]byte) (*TCPConnection, error) {
-	sourcePort := uint16(49152 + rand.Intn(65535-49152+1))
-	// srcIP := [4]byte{127, 0, 0, 1}
-	srcIP := [4]byte{192, 168, 1, 103}
-
-	// Create raw socket
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	d, err := DefaultDemux()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create socket: %v", err)
-	}
-
-	// err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1)
-	// if err != nil {
-	// 	log.Printf("Setsockopt error: %v\n", err)
-	// 	return nil, fmt.Errorf("failed to Setsockopt: %v", err)
-	// }
-
-	// Create IP header
-	ipHeader := &ip.IPHeader{
-		Version:  4,                   // IPv4
-		IHL:      5,                   // 5 x 32-bit words
-		TOS:      0,                   // Type of Service
-		TotalLen: 40,                  // Header length
-		ID:       1,                   // Identification
-		TTL:      64,                  // Time to Live
-		Protocol: syscall.IPPROTO_TCP, // TCP protocol
-		SrcAddr:  srcIP,
-		DstAddr:  srcIP,
+		return nil, err
 	}
+	return d.CreateConnection(destPort, destIP)
+}
 
-	// localAddr := &syscall.SockaddrInet4{
-	// 	Port: int(sourcePort),
-	// 	Addr: srcIP,
-	// }
-
-	// if err := syscall.Bind(fd, localAddr); err != nil {
-	// 	return nil, fmt.Errorf("error binding client socket: %v", err)
-	// }
+// SetConfig replaces the tunables of the connection. It should be called
+// before the connection is opened.
+func (c *TCPConnection) SetConfig(cfg Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return &TCPConnection{
-		srcPort:    sourcePort,
-		destPort:   destPort,
-		srcIP:      srcIP,
-		destIP:     srcIP,
-		seqNum:     generateRandomSeqNum(),
-		ackNum:     0,
-		state:      CLOSED,
-		rawSocket:  fd,
-		maxSegSize: 1460,
-		ipHeader:   *ipHeader,
-	}, nil
+	c.cfg = cfg.withDefaults()
+	if c.demux != nil && c.state == CLOSED {
+		c.demux.resizeInbound(c)
+	}
+	c.rtx.rto.minRTO = c.cfg.MinRTO
+	c.rtx.rto.maxRTO = c.cfg.MaxRTO
+	c.rtx.rto.clamp()
+	c.initCongestion()
 }
 
+// Connect opens the connection with the three-way handshake.
 func (c *TCPConnection) Connect() error {
-	addr := &syscall.SockaddrInet4{
-		Port: int(c.destPort),
-		Addr: c.destIP,
-	}
-	if err := syscall.Connect(c.rawSocket, addr); err != nil {
-		return err
-	}
-	c.state = ESTABLISHED
-	return nil
+	return c.RawConnect()
 }
 
 func (c *TCPConnection) RawConnect() error {
 	synHeader := &protocol.TCPHeader{
 		SourcePort:   c.srcPort,
 		DestPort:     c.destPort,
-		SeqNum:       c.seqNum,
+		SeqNum:       c.iss,
 		ControlFlags: protocol.SYN,
-		WindowSize:   65535,
 		HeaderLen:    5,
 	}
 
 	log.Println("Prepare SYN packet for send")
 
-	syncW := waiter.NewPacketChannels(c.ReceivePacket)
-	syncW.StartReceive()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.processEvent(EventActiveOpen); err != nil {
+		return err
+	}
 
-	time.Sleep(1 * time.Second)
-	// Send SYN
-	if err := c.sendPacket(synHeader); err != nil {
+	// Send SYN, it is retransmitted until the SYN-ACK arrives
+	synHeader.WindowSize = c.synWindow()
+	synHeader.Options = c.synOptions()
+	if err := c.sendReliable(synHeader, nil); err != nil {
+		c.fail(err)
 		return fmt.Errorf("failed to send SYN: %v", err)
 	}
 
 	log.Println("SYN packet send")
 
-	c.state = SYN_SENT
+	// The state machine completes the handshake: a SYN-ACK is answered with
+	// our ACK, a SYN of a simultaneous open with our SYN-ACK
+	go c.receiveLoop()
 
 	log.Println("Wait for SYN-ACK")
-
-	// Wait for SYN-ACK
-	resp, err := syncW.WaitForSynAck()
-	if err != nil {
-		return err
-	}
-
-	log.Println("prepare for send ACK")
-	// Send ACK
-	c.ackNum = resp.SeqNum + 1
-	c.seqNum = c.seqNum + 1
-
-	ackHeader := &protocol.TCPHeader{
-		SourcePort:   c.srcPort,
-		DestPort:     c.destPort,
-		AckNum:       c.ackNum,
-		SeqNum:       c.seqNum,
-		ControlFlags: protocol.ACK,
-		WindowSize:   65535,
-		HeaderLen:    5,
+	c.waitLocked(func() bool { return c.state != SYN_SENT && c.state != SYN_RECEIVED })
+	if c.err != nil {
+		return c.err
 	}
-
-	log.Printf("ACK header")
-	if err := c.sendPacket(ackHeader); err != nil {
-		return fmt.Errorf("failed to send ACK: %v", err)
+	if c.state == CLOSED {
+		return fmt.Errorf("connection closed during the handshake")
 	}
-
-	log.Println("send ACK")
-	c.state = ESTABLISHED
 	return nil
 }
 
-func (c *TCPConnection) SendMessage(data []byte) error {
-	if c.state != ESTABLISHED {
-		return fmt.Errorf("connection is not established")
-	}
-
-	dataHeader := &protocol.TCPHeader{
-		SourcePort:   c.srcPort,
-		DestPort:     c.destPort,
-		AckNum:       c.ackNum,
-		SeqNum:       c.seqNum,
-		ControlFlags: protocol.PSH | protocol.ACK,
-		WindowSize:   0xffff,
-		HeaderLen:    51,
-	}
-
-	if err := c.sendPacketWithPayload(dataHeader, data); err != nil {
-		return fmt.Errorf("failed to send packet with payload: %v", err)
+// receiveLoop processes the segments of an open connection until the demux
+// stops delivering them.
+func (c *TCPConnection) receiveLoop() {
+	for {
+		if _, err := c.receiveSegment(); err != nil {
+			return
+		}
 	}
-
-	return nil
 }
 
-func (c *TCPConnection) Close() error {
-	log.Println("-----CLOSE CONN-----")
-	if c.state != ESTABLISHED {
-		return fmt.Errorf("connection is not established")
+// waitLocked blocks until cond holds or the connection fails. c.mu must be
+// held; it is released while waiting.
+func (c *TCPConnection) waitLocked(cond func() bool) {
+	for !cond() && c.err == nil {
+		ch := c.changed
+		c.mu.Unlock()
+		<-ch
+		c.mu.Lock()
 	}
-
-	if err := syscall.Close(c.rawSocket); err != nil {
-		return fmt.Errorf("failed to close socket: %v", err)
-	}
-
-	c.state = CLOSED
-	return nil
 }
 
-func (c *TCPConnection) RawClose() error {
-	log.Println("-----CLOSE CONN-----")
-	if c.state != ESTABLISHED {
-		return fmt.Errorf("connection is not established")
-	}
-
-	// Send FIN
-	finHeader := &protocol.TCPHeader{
-		SourcePort:   c.srcPort,
-		DestPort:     c.destPort,
-		SeqNum:       c.seqNum + 1,
-		AckNum:       c.ackNum,
-		ControlFlags: protocol.FIN,
-		WindowSize:   65535,
-		HeaderLen:    5,
-	}
-
-	waitC := waiter.NewPacketChannels(c.ReceivePacket)
-	waitC.StartReceive()
-	waitF := waiter.NewPacketChannels(c.ReceivePacket)
-
-	if err := c.sendPacket(finHeader); err != nil {
-		return fmt.Errorf("failed to send FIN: %v", err)
-	}
+func (c *TCPConnection) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
 
-	_, err := waitC.WaitForAck()
-	if err != nil {
-		return fmt.Errorf("failed to receive ACK for FIN: %v", err)
-	}
-	waitF.StartReceive()
+// abort is fail for callers that do not hold c.mu.
+func (c *TCPConnection) abort(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fail(err)
+}
 
-	resp, err := waitC.WaitForFin()
-	if err != nil {
-		return fmt.Errorf("failed to receive FIN: %v", err)
-	}
+// fail tears the connection down after an unrecoverable error and wakes up
+// everyone blocked on it. c.mu must be held.
+func (c *TCPConnection) fail(err error) {
+	c.teardown(EventTimeout, err)
+}
 
-	if err := syscall.Close(c.rawSocket); err != nil {
-		return fmt.Errorf("failed to close socket: %v", err)
+// teardown records err, moves to CLOSED through ev and wakes up everyone
+// blocked on the connection. Only the first error is kept. c.mu must be
+// held.
+func (c *TCPConnection) teardown(ev Event, err error) {
+	if c.err != nil {
+		return
 	}
 
-	c.seqNum++
-	c.ackNum = resp.SeqNum + 1
-
-	// Send ACK
-	ackHeader := &protocol.TCPHeader{
-		SourcePort:   c.srcPort,
-		DestPort:     c.destPort,
-		SeqNum:       c.seqNum,
-		AckNum:       c.ackNum,
-		ControlFlags: protocol.ACK,
-		WindowSize:   65535,
-		HeaderLen:    5,
+	log.Printf("Connection to %v:%d failed: %v", c.destIP, c.destPort, err)
+	c.err = err
+	if c.state != CLOSED {
+		c.processEvent(ev)
 	}
+	c.release()
+	c.notifyLocked()
+}
 
-	if err := c.sendPacket(ackHeader); err != nil {
-		return fmt.Errorf("failed to send final ACK: %v", err)
+// tuple returns the four-tuple the connection is registered under.
+func (c *TCPConnection) tuple() fourTuple {
+	return fourTuple{
+		srcIP:    c.srcIP,
+		srcPort:  c.srcPort,
+		destIP:   c.destIP,
+		destPort: c.destPort,
 	}
-
-	c.state = CLOSED
-	return nil
 }
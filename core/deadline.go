@@ -0,0 +1,79 @@
+package core
+
+import (
+	"net"
+	"tcplay/components/clock"
+	"time"
+)
+
+// Make sure TCPConnection can be used wherever a net.Conn is expected.
+var _ net.Conn = (*TCPConnection)(nil)
+
+// deadline is the read or write deadline of a connection. Its timer wakes up
+// the callers blocked in waitLocked, which then see it exceeded.
+type deadline struct {
+	t     time.Time
+	timer clock.Timer
+}
+
+func (d *deadline) exceeded(now time.Time) bool {
+	return !d.t.IsZero() && !now.Before(d.t)
+}
+
+// setDeadline replaces d and wakes up the waiters. c.mu must be held.
+func (c *TCPConnection) setDeadline(d *deadline, t time.Time) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	d.t = t
+	if wait := clock.Until(c.cfg.Clock, t); !t.IsZero() && wait > 0 {
+		d.timer = c.cfg.Clock.AfterFunc(wait, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.notifyLocked()
+		})
+	}
+
+	// A deadline in the past or a cleared one takes effect right away
+	c.notifyLocked()
+}
+
+// SetDeadline sets the read and write deadlines, see net.Conn.
+func (c *TCPConnection) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDeadline(&c.readDeadline, t)
+	c.setDeadline(&c.writeDeadline, t)
+	return nil
+}
+
+// SetReadDeadline makes Read fail with os.ErrDeadlineExceeded from t on. A
+// zero t means Read does not time out.
+func (c *TCPConnection) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDeadline(&c.readDeadline, t)
+	return nil
+}
+
+// SetWriteDeadline makes Write fail with os.ErrDeadlineExceeded from t on,
+// even if part of the data was queued. A zero t means Write does not time
+// out.
+func (c *TCPConnection) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDeadline(&c.writeDeadline, t)
+	return nil
+}
+
+// LocalAddr returns our end of the connection.
+func (c *TCPConnection) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IP(c.srcIP[:]).To16(), Port: int(c.srcPort)}
+}
+
+// RemoteAddr returns the peer's end of the connection.
+func (c *TCPConnection) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IP(c.destIP[:]).To16(), Port: int(c.destPort)}
+}
@@ -0,0 +1,95 @@
+package core
+
+import "tcplay/protocol"
+
+// quickAckSegments is how many data segments a new connection acknowledges
+// right away, so that the peer's slow start is not held up by delayed ACKs.
+const quickAckSegments = 16
+
+// delayedAck is the state of the delayed ACK policy (RFC 9293, section
+// 3.8.6.3; RFC 5681, section 4.2).
+type delayedAck struct {
+	timer  connTimer
+	quick  int    // segments left in the quick-ACK mode after the start
+	always bool   // SetQuickAck turned delayed ACKs off
+	rcvMSS uint32 // largest segment received, at most the MSS we announced
+}
+
+// SetQuickAck makes the connection acknowledge every data segment right
+// away (quick true) rather than delaying the ACK. Turning it off also ends
+// the quick-ACK mode a new connection starts in, so ACKs are delayed from
+// the next segment on.
+func (c *TCPConnection) SetQuickAck(quick bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.delack.always = quick
+	if !quick {
+		c.delack.quick = 0
+		return nil
+	}
+	if c.synchronized() && c.lastAckSent != c.rcvNxt {
+		c.sendAck()
+	}
+	return nil
+}
+
+// ackReceived acknowledges a segment that carried data or a FIN. The ACK
+// goes out right away if now is set, in quick-ACK mode, and once two full
+// segments are unacknowledged. Otherwise it waits for the delayed ACK
+// timer, unless data we send carries it first. A full segment is the
+// largest one received so far: the peer sends at most the MSS we
+// announced, whatever MSS it announced itself, and less if its path is
+// narrower. c.mu must be held.
+func (c *TCPConnection) ackReceived(now bool) {
+	if c.delack.quick > 0 {
+		c.delack.quick--
+		now = true
+	}
+	if now || c.delack.always || c.rcvNxt-c.lastAckSent >= 2*c.rcvMSS() {
+		c.sendAck()
+		return
+	}
+	if !c.delack.timer.running() {
+		c.arm(&c.delack.timer, c.cfg.DelayedAckTimeout, c.onDelayedAck)
+	}
+}
+
+// measureSegment updates the size of a full segment from a segment of n
+// data bytes. c.mu must be held.
+func (c *TCPConnection) measureSegment(n int) {
+	c.delack.rcvMSS = max(c.delack.rcvMSS, uint32(min(n, defaultMSS)))
+}
+
+// rcvMSS returns the size of a full segment from the peer, no less than
+// the MSS every host accepts until the peer has sent larger segments.
+// c.mu must be held.
+func (c *TCPConnection) rcvMSS() uint32 {
+	return max(c.delack.rcvMSS, peerDefaultMSS)
+}
+
+// ackSent notes the acknowledgment number of an outgoing segment. Once
+// everything received is acknowledged, a delayed ACK is no longer due.
+// c.mu must be held.
+func (c *TCPConnection) ackSent(h *protocol.TCPHeader) {
+	if h.ControlFlags&protocol.ACK == 0 {
+		return
+	}
+	if seqGT(h.AckNum, c.lastAckSent) {
+		c.lastAckSent = h.AckNum
+	}
+	if h.AckNum == c.rcvNxt {
+		c.stopDelayedAck()
+	}
+}
+
+func (c *TCPConnection) stopDelayedAck() {
+	c.delack.timer.stop()
+}
+
+func (c *TCPConnection) onDelayedAck() {
+	if c.err != nil || !c.synchronized() || c.lastAckSent == c.rcvNxt {
+		return
+	}
+	c.sendAck()
+}
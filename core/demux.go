@@ -0,0 +1,482 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"tcplay/components/checksum"
+	"tcplay/components/link"
+	"tcplay/core/ip"
+	"tcplay/protocol"
+)
+
+const (
+	// minInboundQueueLen is the number of segments buffered per connection
+	// on top of what its windows allow, see inboundQueueLen.
+	minInboundQueueLen = 64
+
+	// Ephemeral port range (RFC 6335) used for active opens.
+	ephemeralPortFirst = 49152
+	ephemeralPortLast  = 65535
+
+	ipDefaultTTL    = 64
+	ipDontFragment  = 0x2 // DF in the 3-bit flags field
+	ipMoreFragments = 0x1 // MF
+)
+
+// fourTuple identifies a connection from the local point of view: src is
+// our end, dest is the peer, the same as in TCPConnection.
+type fourTuple struct {
+	srcIP    [4]byte
+	srcPort  uint16
+	destIP   [4]byte
+	destPort uint16
+}
+
+// segment is a TCP segment parsed by the demultiplexer.
+type segment struct {
+	srcIP   [4]byte // sender of the packet
+	destIP  [4]byte // receiver of the packet
+	header  *protocol.TCPHeader
+	payload []byte
+}
+
+// len is the sequence space the segment occupies.
+func (s *segment) len() uint32 {
+	return uint32(len(s.payload)) + controlLen(s.header)
+}
+
+// tuple returns the four-tuple of the connection the segment is addressed to.
+func (s *segment) tuple() fourTuple {
+	return fourTuple{
+		srcIP:    s.destIP,
+		srcPort:  s.header.DestPort,
+		destIP:   s.srcIP,
+		destPort: s.header.SourcePort,
+	}
+}
+
+// Demux owns a link endpoint and its receive loop. Every packet is parsed
+// once and dispatched by four-tuple to the inbound queue of the connection it
+// belongs to. Segments without a connection go to the listener of the
+// destination port, and are answered with RST if there is none.
+//
+// A raw socket sees every TCP packet on the host, so there segments for
+// ports tcplay does not use are left to the kernel and never answered, see
+// LinkEndpoint.SharesHostPorts.
+type Demux struct {
+	link    LinkEndpoint
+	localIP func(dest [4]byte) ([4]byte, error) // source address towards dest
+	ipID    atomic.Uint32
+
+	mu        sync.Mutex
+	conns     map[fourTuple]*TCPConnection
+	listeners map[uint16]*Listener
+	ports     map[uint16]int // local ports in use, with reference counts
+	done      chan struct{}
+	closed    bool
+}
+
+var (
+	defaultDemux     *Demux
+	defaultDemuxErr  error
+	defaultDemuxOnce sync.Once
+)
+
+// DefaultDemux returns the process-wide demultiplexer used by CreateConnection
+// and Listen, creating it on first use.
+func DefaultDemux() (*Demux, error) {
+	defaultDemuxOnce.Do(func() {
+		defaultDemux, defaultDemuxErr = NewDemux()
+	})
+	return defaultDemux, defaultDemuxErr
+}
+
+// NewDemux opens a raw socket and starts the receive loop. Source addresses
+// are picked by the host's routing table.
+func NewDemux() (*Demux, error) {
+	ep, err := link.NewRawSocket()
+	if err != nil {
+		return nil, err
+	}
+	return newDemux(ep, localIPFor), nil
+}
+
+// NewLinkDemux starts a receive loop on ep, which is reached at addr. The
+// demux owns ep from now on and closes it in Close.
+func NewLinkDemux(ep LinkEndpoint, addr [4]byte) *Demux {
+	return newDemux(ep, func([4]byte) ([4]byte, error) { return addr, nil })
+}
+
+func newDemux(ep LinkEndpoint, localIP func(dest [4]byte) ([4]byte, error)) *Demux {
+	d := &Demux{
+		link:      ep,
+		localIP:   localIP,
+		conns:     make(map[fourTuple]*TCPConnection),
+		listeners: make(map[uint16]*Listener),
+		ports:     make(map[uint16]int),
+		done:      make(chan struct{}),
+	}
+
+	go d.receiveLoop()
+	return d
+}
+
+// Close stops the receive loop and closes the link endpoint. Connections
+// still registered fail with net.ErrClosed, and listeners stop accepting.
+func (d *Demux) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return fmt.Errorf("demux already closed")
+	}
+	d.closed = true
+	close(d.done)
+	err := d.link.Close()
+	d.mu.Unlock()
+
+	d.shutdown()
+	return err
+}
+
+// CreateConnection allocates an ephemeral port and registers a new connection
+// to destIP:destPort. The connection is opened with RawConnect.
+func (d *Demux) CreateConnection(destPort uint16, destIP [4]byte) (*TCPConnection, error) {
+	srcIP, err := d.localIP(destIP)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConnection(srcIP, 0, destIP, destPort, DefaultConfig())
+
+	// Pick a random ephemeral port, retrying on collisions
+	span := ephemeralPortLast - ephemeralPortFirst + 1
+	for i := 0; i < span; i++ {
+		c.srcPort = uint16(ephemeralPortFirst + rand.Intn(span))
+		if err := d.register(c); err == nil {
+			return c, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no free ephemeral port for %v:%d", destIP, destPort)
+}
+
+// register makes the demux deliver segments for c's four-tuple to c.
+func (d *Demux) register(c *TCPConnection) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return fmt.Errorf("demux closed")
+	}
+
+	key := c.tuple()
+	if _, ok := d.conns[key]; ok {
+		return fmt.Errorf("four-tuple %v:%d -> %v:%d already in use", key.srcIP, key.srcPort, key.destIP, key.destPort)
+	}
+
+	c.demux = d
+	c.inbound = make(chan *segment, inboundQueueLen(c.cfg))
+	d.conns[key] = c
+	d.ports[key.srcPort]++
+	return nil
+}
+
+// resizeInbound fits the inbound queue of c to a new config, keeping the
+// segments queued already. Nobody may be receiving from it yet.
+func (d *Demux) resizeInbound(c *TCPConnection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := inboundQueueLen(c.cfg)
+	if d.conns[c.tuple()] != c || n == cap(c.inbound) {
+		return
+	}
+	q := make(chan *segment, max(n, len(c.inbound)))
+	for len(c.inbound) > 0 {
+		q <- <-c.inbound
+	}
+	c.inbound = q
+}
+
+// inboundQueueLen returns how many segments are buffered for a connection
+// with cfg: a receive window full of full-sized segments and an ACK for
+// each segment of a full send buffer. Both windows may be in flight at
+// once, and a lossless link should not drop any of it.
+func inboundQueueLen(cfg Config) int {
+	return minInboundQueueLen + (cfg.ReceiveBufferSize+cfg.SendBufferSize)/defaultMSS
+}
+
+// unregister stops delivery to c and closes its inbound queue.
+func (d *Demux) unregister(c *TCPConnection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := c.tuple()
+	if d.conns[key] == c {
+		delete(d.conns, key)
+		close(c.inbound)
+		d.releasePortLocked(key.srcPort)
+	}
+}
+
+func (d *Demux) registerListener(l *Listener) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return fmt.Errorf("demux closed")
+	}
+	if _, ok := d.listeners[l.port]; ok {
+		return fmt.Errorf("port %d already has a listener", l.port)
+	}
+
+	d.listeners[l.port] = l
+	d.ports[l.port]++
+	return nil
+}
+
+func (d *Demux) unregisterListener(l *Listener) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.listeners[l.port] == l {
+		delete(d.listeners, l.port)
+		d.releasePortLocked(l.port)
+	}
+}
+
+func (d *Demux) releasePortLocked(port uint16) {
+	d.ports[port]--
+	if d.ports[port] <= 0 {
+		delete(d.ports, port)
+	}
+}
+
+// send wraps a TCP segment from src to dest in an IPv4 header and writes
+// it to the link.
+func (d *Demux) send(src, dest [4]byte, seg []byte) error {
+	ipHeader := &ip.IPHeader{
+		Version:  4,
+		IHL:      5,
+		TotalLen: uint16(20 + len(seg)),
+		ID:       uint16(d.ipID.Add(1)),
+		Flags:    ipDontFragment,
+		TTL:      ipDefaultTTL,
+		Protocol: checksum.ProtocolTCP,
+		SrcAddr:  src,
+		DstAddr:  dest,
+	}
+	return d.link.WritePacket(append(ipHeader.Marshall(), seg...))
+}
+
+func (d *Demux) receiveLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, err := d.link.ReadPacket(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				d.shutdown()
+				return
+			}
+			log.Printf("Demux failed to receive packet: %v", err)
+			continue
+		}
+
+		seg, err := parseSegment(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		d.dispatch(seg)
+	}
+}
+
+// parseSegment decodes the IP and TCP headers of a raw packet.
+func parseSegment(packet []byte) (*segment, error) {
+	ipHeader, err := ip.Serialize(packet)
+	if err != nil {
+		return nil, err
+	}
+	if ipHeader.Version != 4 || ipHeader.IHL < 5 {
+		return nil, fmt.Errorf("not an IPv4 header: version %d, IHL %d", ipHeader.Version, ipHeader.IHL)
+	}
+	if ipHeader.Protocol != checksum.ProtocolTCP {
+		return nil, fmt.Errorf("protocol %d is not TCP", ipHeader.Protocol)
+	}
+
+	// Fragments are not reassembled: the first would be read as a
+	// truncated segment, the others as garbage
+	if ipHeader.Flags&ipMoreFragments != 0 || ipHeader.FragOffset != 0 {
+		return nil, fmt.Errorf("IP fragment at offset %d", int(ipHeader.FragOffset)*8)
+	}
+
+	// Drop link layer padding past the IP total length
+	if int(ipHeader.TotalLen) < len(packet) {
+		packet = packet[:ipHeader.TotalLen]
+	}
+
+	ipHeaderLen := int(ipHeader.IHL) * 4
+	if len(packet) < ipHeaderLen {
+		return nil, fmt.Errorf("packet too short for IP header: %d bytes", len(packet))
+	}
+
+	if !checksum.VerifyTCPIPv4(ipHeader.SrcAddr, ipHeader.DstAddr, packet[ipHeaderLen:]) {
+		return nil, fmt.Errorf("bad TCP checksum")
+	}
+
+	tcpHeader, tcpPayload, err := protocol.ParseTCPHeader(packet[ipHeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+
+	// The receive buffer is reused, so the payload is copied out
+	payload := make([]byte, len(tcpPayload))
+	copy(payload, tcpPayload)
+
+	return &segment{
+		srcIP:   ipHeader.SrcAddr,
+		destIP:  ipHeader.DstAddr,
+		header:  tcpHeader,
+		payload: payload,
+	}, nil
+}
+
+// dispatch delivers seg to its connection, or falls back to the listener on
+// the destination port, or answers with RST.
+func (d *Demux) dispatch(seg *segment) {
+	if d.deliver(seg) {
+		return
+	}
+
+	d.mu.Lock()
+	l := d.listeners[seg.header.DestPort]
+	_, inUse := d.ports[seg.header.DestPort]
+	d.mu.Unlock()
+
+	if l != nil {
+		l.handleSegment(seg)
+		return
+	}
+
+	if inUse || !d.link.SharesHostPorts() {
+		d.unmatched(seg)
+	}
+}
+
+// deliver queues seg on the connection with a matching four-tuple.
+func (d *Demux) deliver(seg *segment) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.conns[seg.tuple()]
+	if !ok {
+		return false
+	}
+
+	select {
+	case c.inbound <- seg:
+	default:
+		log.Printf("Drop packet for port %d: inbound queue full", c.srcPort)
+	}
+	return true
+}
+
+// unmatched answers a segment that belongs to no connection with a RST
+// (RFC 9293, section 3.10.7.1), unless it is a RST itself.
+func (d *Demux) unmatched(seg *segment) {
+	h := seg.header
+	if h.ControlFlags&protocol.RST != 0 {
+		return
+	}
+
+	rst := &protocol.TCPHeader{
+		SourcePort: h.DestPort,
+		DestPort:   h.SourcePort,
+		HeaderLen:  5,
+	}
+	if h.ControlFlags&protocol.ACK != 0 {
+		rst.SeqNum = h.AckNum
+		rst.ControlFlags = protocol.RST
+	} else {
+		rst.AckNum = h.SeqNum + seg.len()
+		rst.ControlFlags = protocol.RST | protocol.ACK
+	}
+
+	log.Printf("No connection for %v:%d -> %v:%d, sending RST", seg.srcIP, h.SourcePort, seg.destIP, h.DestPort)
+	buf, err := marshalSegment(rst, nil, seg.destIP, seg.srcIP)
+	if err != nil {
+		log.Printf("Failed to send RST: %v", err)
+		return
+	}
+	if err := d.send(seg.destIP, seg.srcIP, buf); err != nil {
+		log.Printf("Failed to send RST: %v", err)
+	}
+}
+
+// shutdown tears down every connection and listener once the link
+// endpoint is closed. Whoever waits on them gets net.ErrClosed.
+func (d *Demux) shutdown() {
+	d.mu.Lock()
+	d.closed = true
+	conns := make([]*TCPConnection, 0, len(d.conns))
+	for key, c := range d.conns {
+		delete(d.conns, key)
+		close(c.inbound)
+		conns = append(conns, c)
+	}
+	listeners := make([]*Listener, 0, len(d.listeners))
+	for port, l := range d.listeners {
+		delete(d.listeners, port)
+		listeners = append(listeners, l)
+	}
+	d.ports = make(map[uint16]int)
+	d.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		c.teardown(EventAbort, net.ErrClosed)
+		c.mu.Unlock()
+	}
+	for _, l := range listeners {
+		l.demuxClosed()
+	}
+}
+
+// controlLen is the sequence space taken by the control flags of h: SYN and
+// FIN count as one each.
+func controlLen(h *protocol.TCPHeader) uint32 {
+	var n uint32
+	if h.ControlFlags&protocol.SYN != 0 {
+		n++
+	}
+	if h.ControlFlags&protocol.FIN != 0 {
+		n++
+	}
+	return n
+}
+
+// localIPFor returns the source address the kernel uses to reach dest. It
+// connects a UDP socket, which only does a route lookup and sends nothing.
+func localIPFor(dest [4]byte) ([4]byte, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return [4]byte{}, fmt.Errorf("failed to create socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Connect(fd, &syscall.SockaddrInet4{Port: 9, Addr: dest}); err != nil {
+		return [4]byte{}, fmt.Errorf("no route to %v: %v", dest, err)
+	}
+
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return [4]byte{}, fmt.Errorf("failed to get local address: %v", err)
+	}
+	return sa.(*syscall.SockaddrInet4).Addr, nil
+}
@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"tcplay/components/checksum"
+	"tcplay/components/link"
+	"tcplay/core/ip"
+	"tcplay/protocol"
+	"testing"
+	"time"
+)
+
+var (
+	clientIP = [4]byte{10, 0, 0, 1}
+	serverIP = [4]byte{10, 0, 0, 2}
+)
+
+// quiet discards the stack's log output for the rest of the test, unless
+// the tests run with -v.
+func quiet(t *testing.T) {
+	if testing.Verbose() {
+		return
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// pipeStacks returns two stacks connected by a lossless in-memory link.
+func pipeStacks(t *testing.T) (client, server *Demux) {
+	t.Helper()
+	quiet(t)
+	a, b := link.Pipe()
+	client = NewLinkDemux(a, clientIP)
+	server = NewLinkDemux(b, serverIP)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// connect opens a connection from client to a listener on server and
+// returns both ends.
+func connect(t *testing.T, client, server *Demux) (*TCPConnection, *TCPConnection) {
+	t.Helper()
+	l, err := server.Listen(80, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	conn, err := client.CreateConnection(80, serverIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, accepted
+}
+
+func TestBulkTransferWithoutRetransmits(t *testing.T) {
+	client, server := pipeStacks(t)
+	conn, accepted := connect(t, client, server)
+
+	received := make(chan []byte)
+	go func() {
+		data, err := io.ReadAll(accepted)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- data
+	}()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, not the %d sent", len(got), len(data))
+	}
+	if st := conn.Stats(); st.Retransmits != 0 {
+		t.Errorf("%d retransmits on a lossless link: %+v", st.Retransmits, st)
+	}
+}
+
+func TestCloseTearsDownConnections(t *testing.T) {
+	client, server := pipeStacks(t)
+	conn, _ := connect(t, client, server)
+
+	read := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		read <- err
+	}()
+
+	client.Close()
+	select {
+	case err := <-read:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Read returned %v, want net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read still blocked after Close")
+	}
+	if s := conn.State(); s != CLOSED {
+		t.Errorf("state %s after Close, want CLOSED", s)
+	}
+}
+
+func TestConnectToClosedPortIsRefused(t *testing.T) {
+	client, _ := pipeStacks(t)
+
+	conn, err := client.CreateConnection(81, serverIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = conn.Connect()
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("Connect returned %v, want ECONNREFUSED", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Connect took %v to fail", d)
+	}
+}
+
+func TestParseSegmentDropsMalformedIP(t *testing.T) {
+	seg, err := marshalSegment(&protocol.TCPHeader{
+		SourcePort: 40000, DestPort: 80, SeqNum: 1, ControlFlags: protocol.SYN,
+	}, []byte("data"), clientIP, serverIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := func(h ip.IPHeader) []byte {
+		h.TotalLen = uint16(20 + len(seg))
+		h.Protocol = checksum.ProtocolTCP
+		h.SrcAddr, h.DstAddr = clientIP, serverIP
+		return append(h.Marshall(), seg...)
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		ok     bool
+	}{
+		{"valid", packet(ip.IPHeader{Version: 4, IHL: 5, Flags: ipDontFragment}), true},
+		{"IPv6", packet(ip.IPHeader{Version: 6, IHL: 5}), false},
+		{"IHL 4", packet(ip.IPHeader{Version: 4, IHL: 4}), false},
+		{"IHL 0", packet(ip.IPHeader{Version: 4, IHL: 0}), false},
+		{"first fragment", packet(ip.IPHeader{Version: 4, IHL: 5, Flags: ipMoreFragments}), false},
+		{"middle fragment", packet(ip.IPHeader{Version: 4, IHL: 5, Flags: ipMoreFragments, FragOffset: 185}), false},
+		{"last fragment", packet(ip.IPHeader{Version: 4, IHL: 5, FragOffset: 185}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseSegment(tt.packet)
+			if tt.ok && (err != nil || string(s.payload) != "data") {
+				t.Fatalf("valid packet parsed as %+v, %v", s, err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("malformed packet accepted as %+v", s.header)
+			}
+		})
+	}
+}
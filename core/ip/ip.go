@@ -3,8 +3,8 @@ package ip
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
 	"syscall"
+	"tcplay/components/checksum"
 )
 
 // IPv4 Header Format
@@ -57,7 +57,6 @@ func (header *IPHeader) Marshall() []byte {
 	header.Checksum = CalculateChecksum(headerBytes)
 	binary.BigEndian.PutUint16(headerBytes[10:], header.Checksum)
 
-	log.Printf("IP Header packet: %+v\n", header)
 	return headerBytes
 }
 
@@ -72,7 +71,8 @@ func Serialize(data []byte) (*IPHeader, error) {
 		TOS:        uint8(data[1]),
 		TotalLen:   binary.BigEndian.Uint16(data[2:4]),
 		ID:         binary.BigEndian.Uint16(data[4:6]),
-		FragOffset: binary.BigEndian.Uint16(data[6:8]),
+		Flags:      binary.BigEndian.Uint16(data[6:8]) >> 13,
+		FragOffset: binary.BigEndian.Uint16(data[6:8]) & 0x1fff,
 		TTL:        uint8(data[8]),
 		Protocol:   uint8(data[9]),
 		Checksum:   binary.BigEndian.Uint16(data[10:12]),
@@ -131,11 +131,5 @@ func ReceivePacket(fd int) []byte {
 }
 
 func CalculateChecksum(data []byte) uint16 {
-	var sum uint32
-	for i := 0; i < len(data)-1; i += 2 {
-		sum += uint32(data[i])<<8 | uint32(data[i+1])
-	}
-	sum = (sum >> 16) + (sum & 0xffff)
-	sum = sum + (sum >> 16)
-	return ^uint16(sum)
+	return checksum.Checksum(data, 0)
 }
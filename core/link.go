@@ -0,0 +1,26 @@
+package core
+
+// LinkEndpoint carries IPv4 packets between the demux and a network. The
+// demux is its only user: it reads every packet from it in one goroutine
+// and writes from any number of connections at once.
+//
+// Implementations live in components/link: a raw socket on the host's IP
+// stack, a Linux TUN device and an in-memory pipe.
+type LinkEndpoint interface {
+	// ReadPacket blocks until a packet arrives and copies it, IP header
+	// included, into b. Once the endpoint is closed it returns
+	// net.ErrClosed.
+	ReadPacket(b []byte) (int, error)
+
+	// WritePacket sends one IPv4 packet, IP header included. Whether it is
+	// delivered is up to the network, as with any datagram.
+	WritePacket(pkt []byte) error
+
+	// SharesHostPorts reports whether the host's own TCP sees the packets
+	// as well. Ports tcplay does not use then belong to the host, and the
+	// demux leaves segments for them unanswered instead of sending RST.
+	SharesHostPorts() bool
+
+	// Close releases the endpoint and unblocks ReadPacket.
+	Close() error
+}
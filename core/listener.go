@@ -0,0 +1,207 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"tcplay/protocol"
+)
+
+// DefaultBacklog is used when Listen is called with a non-positive backlog.
+const DefaultBacklog = 16
+
+// Listener accepts incoming connections on a local port (passive open).
+// The demux hands it every segment for its port that has no connection yet;
+// it answers SYNs with SYN-ACK and hands established connections out
+// through Accept.
+type Listener struct {
+	port    uint16
+	backlog int
+	demux   *Demux
+	cfg     Config
+
+	mu       sync.Mutex
+	state    State
+	pending  int // connections still in the handshake
+	acceptCh chan *TCPConnection
+	done     chan struct{}
+}
+
+// Listen starts accepting connections on port using the default demux.
+func Listen(port uint16, backlog int) (*Listener, error) {
+	d, err := DefaultDemux()
+	if err != nil {
+		return nil, err
+	}
+	return d.Listen(port, backlog)
+}
+
+// Listen starts accepting connections on port. backlog limits the number of
+// connections that are in the handshake or established but not yet
+// accepted; SYNs beyond it are dropped.
+func (d *Demux) Listen(port uint16, backlog int) (*Listener, error) {
+	if backlog <= 0 {
+		backlog = DefaultBacklog
+	}
+
+	state, err := Transition(CLOSED, EventPassiveOpen)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		port:     port,
+		backlog:  backlog,
+		demux:    d,
+		cfg:      DefaultConfig(),
+		state:    state,
+		acceptCh: make(chan *TCPConnection, backlog),
+		done:     make(chan struct{}),
+	}
+
+	if err := d.registerListener(l); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Listening on port %d (backlog %d)", port, backlog)
+	return l, nil
+}
+
+// Port returns the local port the listener is bound to.
+func (l *Listener) Port() uint16 {
+	return l.port
+}
+
+// SetConfig sets the configuration of connections accepted from now on.
+func (l *Listener) SetConfig(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg.withDefaults()
+}
+
+// Accept waits for the next established connection. It returns
+// net.ErrClosed once the listener is closed.
+func (l *Listener) Accept() (*TCPConnection, error) {
+	select {
+	case c := <-l.acceptCh:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections. Connections that were not accepted yet
+// are dropped; accepted ones are not affected.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state, err := Transition(l.state, EventClose)
+	if err != nil {
+		return err
+	}
+	l.state = state
+	close(l.done)
+	l.demux.unregisterListener(l)
+
+drain:
+	for {
+		select {
+		case c := <-l.acceptCh:
+			c.Abort()
+		default:
+			break drain
+		}
+	}
+
+	log.Printf("Listener on port %d closed", l.port)
+	return nil
+}
+
+// demuxClosed is called when the demux shuts down under the listener.
+func (l *Listener) demuxClosed() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.state == LISTEN {
+		l.state = CLOSED
+		close(l.done)
+	}
+}
+
+// handleSegment starts a handshake for a SYN from an unknown peer. Anything
+// else reaching the listener is answered with RST.
+func (l *Listener) handleSegment(seg *segment) {
+	h := seg.header
+	if h.ControlFlags&(protocol.SYN|protocol.ACK|protocol.RST) != protocol.SYN {
+		l.demux.unmatched(seg)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.state != LISTEN {
+		return
+	}
+
+	if l.pending+len(l.acceptCh) >= l.backlog {
+		log.Printf("Drop SYN from %v:%d: backlog full", seg.srcIP, h.SourcePort)
+		return
+	}
+
+	c := newConnection(seg.destIP, l.port, seg.srcIP, h.SourcePort, l.cfg)
+	if err := c.processEvent(EventPassiveOpen); err != nil {
+		log.Printf("Drop SYN from %v:%d: %v", seg.srcIP, h.SourcePort, err)
+		return
+	}
+	if err := l.demux.register(c); err != nil {
+		log.Printf("Drop SYN from %v:%d: %v", seg.srcIP, h.SourcePort, err)
+		return
+	}
+
+	l.pending++
+	c.inbound <- seg
+
+	go l.handshake(c)
+}
+
+// handshake completes the passive open of c: the state machine answers
+// the SYN with a SYN-ACK, and the final ACK establishes the connection.
+func (l *Listener) handshake(c *TCPConnection) {
+	go c.receiveLoop()
+
+	c.mu.Lock()
+	c.waitLocked(func() bool { return c.state != LISTEN && c.state != SYN_RECEIVED })
+	err := c.err
+	if err == nil && c.state == CLOSED {
+		err = fmt.Errorf("connection closed during the handshake")
+	}
+	c.mu.Unlock()
+	if err != nil {
+		l.abortHandshake(c, err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending--
+
+	if l.state != LISTEN {
+		c.Abort()
+		return
+	}
+
+	log.Printf("Accepted connection from %v:%d", c.destIP, c.destPort)
+	l.acceptCh <- c
+}
+
+func (l *Listener) abortHandshake(c *TCPConnection, err error) {
+	log.Printf("Handshake with %v:%d failed: %v", c.destIP, c.destPort, err)
+	c.abort(err)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending--
+}
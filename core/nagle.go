@@ -0,0 +1,57 @@
+package core
+
+// SetNoDelay turns Nagle's algorithm off (noDelay true) or back on. With it
+// off, every write goes out right away however small it is. Nagle's
+// algorithm is on by default, see net.TCPConn.SetNoDelay.
+func (c *TCPConnection) SetNoDelay(noDelay bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.noDelay = noDelay
+	if noDelay && c.canOutput() {
+		return c.output()
+	}
+	return nil
+}
+
+// SetCork holds back segments shorter than the MSS while cork is true, so
+// that a response written in several pieces goes out in full-sized
+// segments. Uncorking sends what is left right away, like TCP_CORK on
+// Linux. Closing the connection for writing uncorks it too.
+func (c *TCPConnection) SetCork(cork bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cork = cork
+	if !cork && c.canOutput() {
+		return c.output()
+	}
+	return nil
+}
+
+// holdBack reports whether output should wait with a segment of n bytes,
+// shorter than the MSS, out of unsent bytes ready to go. c.mu must be held.
+func (c *TCPConnection) holdBack(n, unsent int) bool {
+	inFlight := c.sndNxt != c.sndUna
+
+	// Sender-side SWS avoidance (RFC 1122, section 4.2.3.4): a segment cut
+	// short by the window goes out only if it fills half the largest window
+	// the peer offered, or if nothing is in flight whose ACK would open the
+	// window further.
+	if n < unsent {
+		return inFlight && n < int(c.maxSndWnd/2)
+	}
+
+	// The last bytes before our FIN are never held: nothing will join them
+	if c.finQueued {
+		return false
+	}
+	if c.cork {
+		return true
+	}
+
+	// Nagle's algorithm (RFC 896) in Minshall's variant: a small segment
+	// waits only while an earlier small segment is unacknowledged, so the
+	// tail of a large write is not delayed by the segments before it.
+	return !c.noDelay && seqGT(c.sndSml, c.sndUna)
+}
@@ -0,0 +1,299 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"tcplay/components/clock"
+	"tcplay/components/netsim"
+	"tcplay/core/congestion"
+	"testing"
+	"time"
+)
+
+// netsimConfig makes timeouts short enough for tests on the wall clock.
+var netsimConfig = Config{
+	MinRTO: 20 * time.Millisecond,
+	MSL:    50 * time.Millisecond,
+}
+
+// TestTransferOverImpairedLink opens a connection, sends data both ways and
+// closes it over a link that loses, reorders, duplicates or corrupts
+// packets in both directions.
+func TestTransferOverImpairedLink(t *testing.T) {
+	quiet(t)
+	tests := []struct {
+		name  string
+		link  netsim.LinkConfig
+		lossy bool // the client must retransmit, fast retransmits among them
+	}{
+		{"loss", netsim.LinkConfig{Loss: 0.03}, true},
+		{"reorder", netsim.LinkConfig{Latency: 2 * time.Millisecond, Jitter: time.Millisecond, Reorder: 0.05}, false},
+		{"duplicate", netsim.LinkConfig{Duplicate: 0.05}, false},
+		{"corrupt", netsim.LinkConfig{Corrupt: 0.03}, true},
+		{"all", netsim.LinkConfig{
+			Loss: 0.02, Latency: time.Millisecond, Jitter: time.Millisecond,
+			Reorder: 0.02, Duplicate: 0.02, Corrupt: 0.02,
+		}, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			conn, _ := transfer(t, netsim.Config{Seed: int64(i), AtoB: tt.link, BtoA: tt.link}, netsimConfig)
+			if st := conn.Stats(); tt.lossy && (st.Retransmits == 0 || st.FastRetransmits == 0) {
+				t.Errorf("no retransmits or no fast retransmits while sending over a lossy link: %+v", st)
+			}
+		})
+	}
+}
+
+// TestCongestionControlOverLossyLink runs the transfer once per congestion
+// control algorithm over a link with a few milliseconds of delay and loss.
+func TestCongestionControlOverLossyLink(t *testing.T) {
+	quiet(t)
+	link := netsim.LinkConfig{Loss: 0.02, Latency: 2 * time.Millisecond}
+	for _, cc := range []string{congestion.Reno, congestion.Cubic, congestion.BBR} {
+		t.Run(cc, func(t *testing.T) {
+			t.Parallel()
+			cfg := netsimConfig
+			cfg.CongestionControl = cc
+			conn, _ := transfer(t, netsim.Config{Seed: 1, AtoB: link, BtoA: link}, cfg)
+			if st := conn.Stats(); st.Retransmits == 0 || st.FastRetransmits == 0 {
+				t.Errorf("no retransmits or no fast retransmits while sending over a lossy link: %+v", st)
+			}
+		})
+	}
+}
+
+// transfer connects two stacks over a simulated link, sends a request of
+// 200 KiB and a response of 50 KiB, closes the connection from both ends
+// and waits for both to reach CLOSED. It returns the client's and the
+// server's connection.
+func transfer(t *testing.T, sim netsim.Config, cfg Config) (*TCPConnection, *TCPConnection) {
+	t.Helper()
+	a, b := netsim.Pipe(sim)
+	client := NewLinkDemux(a, clientIP)
+	server := NewLinkDemux(b, serverIP)
+	defer client.Close()
+	defer server.Close()
+
+	l, err := server.Listen(80, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetConfig(cfg)
+	defer l.Close()
+
+	request := make([]byte, 200*1024)
+	response := make([]byte, 50*1024)
+	rand.Read(request)
+	rand.Read(response)
+
+	// The server reads the whole request, answers and closes
+	served := make(chan *TCPConnection, 1)
+	go func() {
+		defer close(served)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		got, err := io.ReadAll(conn)
+		if err != nil || !bytes.Equal(got, request) {
+			t.Errorf("server received %d bytes (%v), want the %d sent", len(got), err, len(request))
+		}
+		if _, err := conn.Write(response); err != nil {
+			t.Error(err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Error(err)
+		}
+		served <- conn
+	}()
+
+	conn, err := client.CreateConnection(80, serverIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetConfig(cfg)
+	if err := conn.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil || !bytes.Equal(got, response) {
+		t.Errorf("client received %d bytes (%v), want the %d sent", len(got), err, len(response))
+	}
+	if err := conn.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// Both ends reach CLOSED, the client after TIME_WAIT
+	accepted := <-served
+	waitState(t, conn, CLOSED)
+	if accepted == nil {
+		t.FailNow()
+	}
+	waitState(t, accepted, CLOSED)
+	return conn, accepted
+}
+
+// waitState waits up to ten seconds for c to reach state s.
+func waitState(t *testing.T, c *TCPConnection, s State) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for c.State() != s {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection in %s, want %s", c.State(), s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestOutageOnFakeClock runs a transfer on a clock.Fake through an hour
+// long outage of a lossy link, so that the connection goes through dozens
+// of backed-off RTOs before it completes, and checks that two runs with the
+// same seed end exactly alike.
+func TestOutageOnFakeClock(t *testing.T) {
+	quiet(t)
+	first := outage(t, 7)
+	if first.client.Timeouts < 50 || first.elapsed < time.Hour {
+		t.Fatalf("%d timeouts in %v, want an hour of RTOs", first.client.Timeouts, first.elapsed)
+	}
+	if second := outage(t, 7); second != first {
+		t.Errorf("runs with the same seed differ:\n%+v\n%+v", first, second)
+	}
+}
+
+// outageResult is what a run of outage observed.
+type outageResult struct {
+	elapsed        time.Duration // virtual time until both ends were CLOSED
+	client, server Stats
+	atob, btoa     netsim.Stats
+}
+
+// outage sends 64 KiB from a client to a server over a link with 20ms of
+// latency and 5% loss that goes down for an hour right after the
+// handshake. Virtual time advances from one timer to the next once the
+// stacks have handled everything due.
+func outage(t *testing.T, seed int64) outageResult {
+	t.Helper()
+	clk := clock.NewFake(time.Unix(0, 0))
+	link := netsim.LinkConfig{Latency: 20 * time.Millisecond, Loss: 0.05}
+	a, b := netsim.Pipe(netsim.Config{Seed: seed, Clock: clk, AtoB: link, BtoA: link})
+	client := NewLinkDemux(a, clientIP)
+	server := NewLinkDemux(b, serverIP)
+	defer client.Close()
+	defer server.Close()
+
+	cfg := Config{Clock: clk, MaxRetries: 100}
+	l, err := server.Listen(80, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetConfig(cfg)
+	defer l.Close()
+
+	data := make([]byte, 64*1024)
+	mrand.New(mrand.NewSource(seed)).Read(data)
+
+	served := make(chan *TCPConnection, 1)
+	go func() {
+		defer close(served)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		got, err := io.ReadAll(conn)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("server received %d bytes (%v), want the %d sent", len(got), err, len(data))
+		}
+		conn.Close()
+		served <- conn
+	}()
+
+	conn, err := client.CreateConnection(80, serverIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetConfig(cfg)
+	sent := make(chan error, 1)
+	go func() {
+		if err := conn.Connect(); err != nil {
+			sent <- err
+			return
+		}
+		down := netsim.LinkConfig{Loss: 1}
+		a.SetConfig(down)
+		b.SetConfig(down)
+		clk.AfterFunc(time.Hour, func() {
+			a.SetConfig(link)
+			b.SetConfig(link)
+		})
+		if _, err := conn.Write(data); err != nil {
+			sent <- err
+			return
+		}
+		if err := conn.CloseWrite(); err != nil {
+			sent <- err
+			return
+		}
+		_, err := io.ReadAll(conn)
+		conn.Close()
+		sent <- err
+	}()
+
+	start := clk.Now()
+	var accepted *TCPConnection
+	for {
+		settle(a, b)
+		if accepted == nil {
+			select {
+			case accepted = <-served:
+			default:
+			}
+		}
+		if accepted != nil && conn.State() == CLOSED && accepted.State() == CLOSED {
+			break
+		}
+		d, ok := clk.Next()
+		if !ok {
+			t.Fatalf("stuck at %v: client in %s, no timer pending", clk.Now().Sub(start), conn.State())
+		}
+		clk.Advance(d)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	return outageResult{
+		elapsed: clk.Now().Sub(start),
+		client:  conn.Stats(),
+		server:  accepted.Stats(),
+		atob:    a.Stats(),
+		btoa:    b.Stats(),
+	}
+}
+
+// settle waits until the stacks are done with what is due at the current
+// virtual time: nothing went onto the link for a few milliseconds.
+func settle(a, b *netsim.Endpoint) {
+	last := -1
+	for quiet := 0; quiet < 3; {
+		time.Sleep(time.Millisecond)
+		n := a.Stats().Sent + b.Stats().Sent
+		if n == last {
+			quiet++
+		} else {
+			quiet = 0
+			last = n
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"log"
+	"time"
+)
+
+// pacingSlack is how far ahead of the pacing schedule segments may go out.
+// Timers are too coarse to send every segment on time at high rates, so
+// each wakeup sends the segments due within the next millisecond in a
+// burst.
+const pacingSlack = time.Millisecond
+
+// paced reports whether the congestion controller's pacing rate holds the
+// next segment back. If so, the pacing timer resumes output when it is
+// due. c.mu must be held.
+func (c *TCPConnection) paced() bool {
+	if c.cc.PacingRate() == 0 {
+		return false
+	}
+	due := c.paceNext.Add(-pacingSlack)
+	now := c.cfg.Clock.Now()
+	if !now.Before(due) {
+		return false
+	}
+	if !c.pacer.running() {
+		c.arm(&c.pacer, due.Sub(now), c.onPacingTimeout)
+	}
+	return true
+}
+
+// pace schedules the next segment after n bytes went out at the pacing
+// rate. Time not used for sending is not saved up for a burst later.
+// c.mu must be held.
+func (c *TCPConnection) pace(n int) {
+	rate := c.cc.PacingRate()
+	if rate == 0 {
+		return
+	}
+	now := c.cfg.Clock.Now()
+	if c.paceNext.Before(now) {
+		c.paceNext = now
+	}
+	c.paceNext = c.paceNext.Add(time.Duration(uint64(n) * uint64(time.Second) / rate))
+}
+
+func (c *TCPConnection) stopPacingTimer() {
+	c.pacer.stop()
+}
+
+func (c *TCPConnection) onPacingTimeout() {
+	if c.err != nil || !c.canOutput() {
+		return
+	}
+	if err := c.output(); err != nil {
+		log.Printf("Failed to send paced data: %v", err)
+	}
+}
@@ -5,169 +5,366 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"syscall"
-	"tcplay/core/ip"
+	"tcplay/components/checksum"
 	"tcplay/protocol"
 	"time"
 )
 
 func (c *TCPConnection) sendPacket(header *protocol.TCPHeader) error {
+	c.ackSent(header)
+	c.stampTimestamps(header)
 	// c.ipHeader.TotalLen = uint16(40)
 	// ipHeader := c.ipHeader.Marshall()
 	// fmt.Printf("ip header %v\n", ipHeader)
-	header.Checksum = c.calculateChecksum(header, nil, c.srcIP, c.destIP)
+	buf, err := marshalSegment(header, nil, c.srcIP, c.destIP)
+	if err != nil {
+		return fmt.Errorf("failed to send packet: %v", err)
+	}
 
 	log.Printf("Sending packet: %+v", header)
 
-	buf := make([]byte, 20)
-	binary.BigEndian.PutUint16(buf[0:2], header.SourcePort)
-	binary.BigEndian.PutUint16(buf[2:4], header.DestPort)
-	binary.BigEndian.PutUint32(buf[4:8], header.SeqNum)
-	binary.BigEndian.PutUint32(buf[8:12], header.AckNum)
-	buf[12] = header.HeaderLen << 4
-	buf[13] = header.ControlFlags
-	binary.BigEndian.PutUint16(buf[14:16], header.WindowSize)
-	binary.BigEndian.PutUint16(buf[16:18], header.Checksum)
-	binary.BigEndian.PutUint16(buf[18:20], header.UrgentPtr)
+	if err := c.demux.send(c.srcIP, c.destIP, buf); err != nil {
+		return fmt.Errorf("failed to send packet: %v", err)
+	}
 
-	addr := &syscall.SockaddrInet4{
-		Port: int(c.destPort),
-		Addr: c.destIP,
+	return nil
+}
+
+// ReceivePacket waits for the next segment the demux queued for this
+// connection and feeds it through the state machine. Segments that are
+// illegal in the current state are dropped.
+func (c *TCPConnection) ReceivePacket() (*protocol.TCPHeader, error) {
+	log.Println("Start receiving packets")
+	seg, err := c.receiveSegment()
+	if err != nil {
+		return nil, err
 	}
+	return seg.header, nil
+}
+
+func (c *TCPConnection) receiveSegment() (*segment, error) {
+	for {
+		seg, ok := <-c.inbound
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.err != nil {
+				return nil, c.err
+			}
+			return nil, fmt.Errorf("connection closed")
+		}
 
-	// log.Printf("addr: %+v", addr)
-	// log.Printf("socket %d", c.rawSocket)
-	// mssOption := []byte{0x02, 0x04, 0x05, 0xb4}
-	// buf = append(buf, mssOption...)
+		log.Printf("Received packet: %+v\n", seg.header)
 
-	// ipHeader = append(ipHeader, buf...)
-	// log.Printf("packet len is %d", len(ipHeader))
-	if c.state == ESTABLISHED {
-		if _, err := syscall.Write(c.rawSocket, buf); err != nil {
-			return fmt.Errorf("failed to send packet: %v", err)
+		c.mu.Lock()
+		err := c.handleSegment(seg)
+		failed := c.err
+		c.mu.Unlock()
+		if err != nil {
+			log.Printf("Drop packet: %v", err)
+			continue
 		}
-	} else {
-		if err := syscall.Sendto(c.rawSocket, buf, 0, addr); err != nil {
-			return fmt.Errorf("failed to send packet: %v", err)
+
+		// The segment reset the connection
+		if failed != nil {
+			return nil, failed
 		}
-	}
 
-	return nil
+		return seg, nil
+	}
 }
 
-func (c *TCPConnection) ReceiveIPPacket() (*protocol.TCPHeader, error) {
-	tcpHeaderData := ip.ReceivePacket(c.rawSocket)
+// handleSegment runs an arriving segment through the state machine,
+// processes its acknowledgment and hands its data to the receive path.
+// c.mu must be held.
+func (c *TCPConnection) handleSegment(seg *segment) error {
+	h := seg.header
+	flags := h.ControlFlags
+
+	if c.state == SYN_SENT {
+		return c.handleSynSent(seg)
+	}
 
-	tcpHeader := &protocol.TCPHeader{
-		SourcePort:   binary.BigEndian.Uint16(tcpHeaderData[0:2]),
-		DestPort:     binary.BigEndian.Uint16(tcpHeaderData[2:4]),
-		SeqNum:       binary.BigEndian.Uint32(tcpHeaderData[4:8]),
-		AckNum:       binary.BigEndian.Uint32(tcpHeaderData[8:12]),
-		HeaderLen:    tcpHeaderData[12] >> 4,
-		ControlFlags: tcpHeaderData[13] & 0x3F,
-		WindowSize:   binary.BigEndian.Uint16(tcpHeaderData[14:16]),
-		Checksum:     binary.BigEndian.Uint16(tcpHeaderData[16:18]),
-		UrgentPtr:    binary.BigEndian.Uint16(tcpHeaderData[18:20]),
+	if c.synchronized() {
+		if err := c.checkPAWS(h); err != nil {
+			return err
+		}
 	}
 
-	if tcpHeader.SourcePort == c.destPort && tcpHeader.DestPort == c.srcPort {
-		log.Printf("Received packet: %+v\n", tcpHeader)
-		return tcpHeader, nil
+	// Once synchronized, a segment must fall into the receive window. Old
+	// duplicates (a retransmitted SYN or FIN, say) are answered with an ACK.
+	if c.synchronized() && !c.acceptable(seg) {
+		if h.ControlFlags&protocol.RST == 0 {
+			c.sendAck()
+		}
+		// A FIN coming again in TIME_WAIT means our ACK of it was lost:
+		// restart the 2*MSL wait (RFC 9293, section 3.10.7.4)
+		if h.ControlFlags&protocol.FIN != 0 && c.state == TIME_WAIT {
+			c.startTimeWait()
+		}
+		return fmt.Errorf("segment %d outside the receive window", h.SeqNum)
 	}
 
-	return nil, fmt.Errorf("no packet send")
+	if c.synchronized() {
+		c.updateTSRecent(h)
+		if err := c.checkSynchronized(h); err != nil {
+			return err
+		}
+		if flags&protocol.RST != 0 {
+			return c.handleRst(h)
+		}
+	}
+
+	return c.processSegment(seg)
 }
 
-func (c *TCPConnection) ReceivePacket() (*protocol.TCPHeader, error) {
-	buf := make([]byte, 65535)
-	log.Println("Start receiving packets")
-	for {
-		var n int
-		var err error
-		if c.state == ESTABLISHED {
-			n, err = syscall.Read(c.rawSocket, buf)
-			if err != nil {
-				return nil, fmt.Errorf("failed to receive packet: %v", err)
-			}
-		} else {
-			var from syscall.Sockaddr
-			n, from, err = syscall.Recvfrom(c.rawSocket, buf, 0)
-			if err != nil {
-				return nil, fmt.Errorf("failed to receive packet: %v", err)
-			}
-			log.Printf("packet from: %+v", from)
+// handleSynSent handles a segment arriving in SYN_SENT (RFC 9293, section
+// 3.10.7.3): a RST only counts if it acknowledges our SYN, and an ACK of
+// anything else is answered with a RST. c.mu must be held.
+func (c *TCPConnection) handleSynSent(seg *segment) error {
+	h := seg.header
+	flags := h.ControlFlags
+
+	if flags&protocol.ACK != 0 && (seqLEQ(h.AckNum, c.iss) || seqGT(h.AckNum, c.sndNxt)) {
+		if flags&protocol.RST == 0 {
+			c.sendRst(h.AckNum)
 		}
+		return fmt.Errorf("ACK %d does not acknowledge our SYN", h.AckNum)
+	}
 
-		if n < 20 {
-			continue
+	if flags&protocol.RST != 0 {
+		if flags&protocol.ACK == 0 {
+			return fmt.Errorf("RST without ACK in SYN_SENT")
 		}
+		c.reset(EventRcvRst, &ConnectionResetError{Refused: true})
+		return nil
+	}
+
+	return c.processSegment(seg)
+}
+
+// checkSynchronized applies the checks of RFC 5961 to a segment in the
+// receive window of a synchronized connection: a SYN or an ACK for data
+// long acknowledged gets a challenge ACK, an ACK for data never sent a
+// plain one, and a bad ACK in SYN_RECEIVED a RST. c.mu must be held.
+func (c *TCPConnection) checkSynchronized(h *protocol.TCPHeader) error {
+	flags := h.ControlFlags
+	if flags&protocol.RST != 0 {
+		return nil
+	}
+
+	if flags&protocol.SYN != 0 && c.state != SYN_RECEIVED {
+		c.sendChallengeAck()
+		return fmt.Errorf("SYN %d on a synchronized connection", h.SeqNum)
+	}
+
+	if flags&protocol.ACK == 0 {
+		return nil
+	}
+
+	if c.state == SYN_RECEIVED && (seqLEQ(h.AckNum, c.sndUna) || seqGT(h.AckNum, c.sndNxt)) {
+		c.sendRst(h.AckNum)
+		return fmt.Errorf("ACK %d does not acknowledge our SYN", h.AckNum)
+	}
 
-		ipHeaderLen := int(buf[0]&0x0F) * 4
-		if c.state == SYN_SENT {
-			if n < ipHeaderLen+20 {
-				log.Println("Skip packet len is less than < ipheaderLen + 20")
-				continue
+	if seqGT(h.AckNum, c.sndNxt) {
+		c.sendAck()
+		return fmt.Errorf("ACK %d for data not sent yet", h.AckNum)
+	}
+	if seqLT(h.AckNum, c.sndUna-c.maxSndWnd) {
+		c.sendChallengeAck()
+		return fmt.Errorf("ACK %d older than the send window", h.AckNum)
+	}
+	return nil
+}
+
+// processSegment runs a segment that passed all checks through the state
+// machine. c.mu must be held.
+func (c *TCPConnection) processSegment(seg *segment) error {
+	h := seg.header
+
+	ev, err := c.segmentEvent(h)
+	if err != nil {
+		return err
+	}
+
+	prev := c.state
+	if err := c.processEvent(ev); err != nil {
+		return err
+	}
+
+	if (ev == EventRcvSyn || ev == EventRcvSynAck) && (prev == LISTEN || prev == SYN_SENT) {
+		c.irs = h.SeqNum
+		c.rcvNxt = h.SeqNum + 1
+		c.lastAckSent = c.rcvNxt
+		c.rcvAdv = c.rcvNxt
+		c.setSendWindow(h)
+		c.setPeerMSS(h)
+		c.sackPermitted = h.Option(protocol.OptionSACKPermitted) != nil
+		c.setWindowScale(h)
+		c.setTimestamps(h)
+		c.initCongestion()
+
+		if ev == EventRcvSyn {
+			if err := c.sendSynAck(); err != nil {
+				c.fail(fmt.Errorf("failed to send SYN-ACK: %v", err))
+				return nil
 			}
 		}
+	}
 
-		ipProtocol := buf[9]
-		if ipProtocol != 6 { // TCP protocol number
-			log.Println("Skip packet, protocol is not TCP")
-			log.Printf("Received packet protocol number: %v", buf[9])
-			// log.Printf("Received packet: %v", buf)
+	if h.ControlFlags&protocol.ACK != 0 {
+		dup := c.isDupAck(seg)
+		una := c.sndUna
 
-			continue
+		c.handleAck(h)
+		c.updateSendWindow(h)
+		c.updateScoreboard(h)
+
+		if dup {
+			c.onDupAck()
+		} else if seqGT(c.sndUna, una) {
+			c.onNewAck(c.sndUna - una)
 		}
 
-		tcpHeaderData := buf[ipHeaderLen : ipHeaderLen+20]
+		// The peer answers our probes of its zero window: it is alive, so
+		// keep probing however long it takes (RFC 1122, section 4.2.2.17)
+		if c.sndWnd == 0 {
+			c.rtx.retries = 0
+		}
 
-		tcpHeader := &protocol.TCPHeader{
-			SourcePort:   binary.BigEndian.Uint16(tcpHeaderData[0:2]),
-			DestPort:     binary.BigEndian.Uint16(tcpHeaderData[2:4]),
-			SeqNum:       binary.BigEndian.Uint32(tcpHeaderData[4:8]),
-			AckNum:       binary.BigEndian.Uint32(tcpHeaderData[8:12]),
-			HeaderLen:    tcpHeaderData[12] >> 4,
-			ControlFlags: tcpHeaderData[13] & 0x3F,
-			WindowSize:   binary.BigEndian.Uint16(tcpHeaderData[14:16]),
-			Checksum:     binary.BigEndian.Uint16(tcpHeaderData[16:18]),
-			UrgentPtr:    binary.BigEndian.Uint16(tcpHeaderData[18:20]),
+		if c.canOutput() {
+			if err := c.output(); err != nil {
+				log.Printf("Failed to send data: %v", err)
+			}
 		}
+	}
 
-		if tcpHeader.SourcePort == c.destPort && tcpHeader.DestPort == c.srcPort {
-			log.Printf("Received packet: %+v\n", tcpHeader)
-			return tcpHeader, nil
+	// The handshake is complete: our SYN was acknowledged, and a SYN-ACK
+	// from the peer is acknowledged in turn
+	if c.state == ESTABLISHED && (prev == SYN_SENT || prev == SYN_RECEIVED) {
+		c.synDone()
+		if prev == SYN_SENT {
+			c.sendAck()
 		}
 	}
-}
 
-func (c *TCPConnection) sendPacketWithPayload(header *protocol.TCPHeader, payload []byte) error {
-	log.Printf("Sending packet with payload:\n %+v", header)
+	if len(seg.payload) > 0 || h.ControlFlags&protocol.FIN != 0 {
+		c.receiveData(seg)
+	}
 
-	headerBytes := header.Serialize()
+	return nil
+}
 
-	packet := append(headerBytes, payload...)
+// setPeerMSS limits the segments we send to the MSS the peer announced in
+// its SYN. c.mu must be held.
+func (c *TCPConnection) setPeerMSS(h *protocol.TCPHeader) {
+	mss := uint16(peerDefaultMSS)
+	if opt, ok := h.Option(protocol.OptionMSS).(protocol.MSSOption); ok {
+		mss = opt.MSS
+	}
+	c.maxSegSize = min(defaultMSS, max(mss, 1))
+}
 
-	if c.state == ESTABLISHED {
-		if _, err := syscall.Write(c.rawSocket, packet); err != nil {
-			return fmt.Errorf("failed to send packet with payload: %v", err)
-		}
-	} else {
-		addr := &syscall.SockaddrInet4{
-			Port: int(c.destPort),
-			Addr: c.destIP,
-		}
-		if err := syscall.Sendto(c.rawSocket, packet, 0, addr); err != nil {
-			return fmt.Errorf("failed to send packet with payload: %v", err)
+// synOptions returns the options of our SYN or SYN-ACK. A SYN-ACK only
+// offers SACK, timestamps and window scaling if the peer's SYN did. The
+// timestamps are filled in by stampTimestamps. c.mu must be held.
+func (c *TCPConnection) synOptions() []protocol.Option {
+	opts := []protocol.Option{protocol.MSSOption{MSS: defaultMSS}}
+	active := c.state != SYN_RECEIVED
+	sack := active || c.sackPermitted
+	if sack {
+		opts = append(opts, protocol.SACKPermittedOption{})
+	}
+	if active || c.ts.ok {
+		if !sack {
+			opts = append(opts, protocol.NOPOption{}, protocol.NOPOption{})
 		}
+		opts = append(opts, protocol.TimestampsOption{})
+	}
+	if active || c.wscaleOK {
+		opts = append(opts, protocol.NOPOption{}, protocol.WindowScaleOption{Shift: c.windowShift()})
+	}
+	return opts
+}
+
+// sendAck sends a bare ACK for everything received so far, with SACK
+// blocks for the data held beyond it.
+func (c *TCPConnection) sendAck() {
+	ackHeader := &protocol.TCPHeader{
+		SourcePort:   c.srcPort,
+		DestPort:     c.destPort,
+		SeqNum:       c.sndNxt,
+		AckNum:       c.rcvNxt,
+		ControlFlags: protocol.ACK,
+		WindowSize:   c.advertisedWindow(),
+		HeaderLen:    5,
+	}
+	if opt := c.sackOption(c.timestampsLen()); opt != nil {
+		ackHeader.Options = append(ackHeader.Options, opt)
+	}
+
+	if err := c.sendPacket(ackHeader); err != nil {
+		log.Printf("Failed to send ACK: %v", err)
+	}
+}
+
+// sendSynAck answers the peer's SYN with our SYN-ACK, retransmitted until
+// it is acknowledged. In a simultaneous open our SYN is queued already and
+// turns into the SYN-ACK (RFC 9293, section 3.10.7.3). c.mu must be held.
+func (c *TCPConnection) sendSynAck() error {
+	if len(c.rtx.segments) > 0 {
+		s := c.rtx.segments[0]
+		s.header.ControlFlags |= protocol.ACK
+		s.header.Options = c.synOptions()
+		c.retransmit(s)
+		return nil
+	}
+
+	synAckHeader := &protocol.TCPHeader{
+		SourcePort:   c.srcPort,
+		DestPort:     c.destPort,
+		SeqNum:       c.iss,
+		AckNum:       c.rcvNxt,
+		ControlFlags: protocol.SYN | protocol.ACK,
+		WindowSize:   c.synWindow(),
+		HeaderLen:    5,
+		Options:      c.synOptions(),
+	}
+	return c.sendReliable(synAckHeader, nil)
+}
+
+func (c *TCPConnection) sendPacketWithPayload(header *protocol.TCPHeader, payload []byte) error {
+	c.ackSent(header)
+	c.stampTimestamps(header)
+	packet, err := marshalSegment(header, payload, c.srcIP, c.destIP)
+	if err != nil {
+		return fmt.Errorf("failed to send packet with payload: %v", err)
+	}
+
+	log.Printf("Sending packet with payload:\n %+v", header)
+
+	if err := c.demux.send(c.srcIP, c.destIP, packet); err != nil {
+		return fmt.Errorf("failed to send packet with payload: %v", err)
 	}
 
 	return nil
 }
 
-// func (c *TCPConnection) calculateChecksum(header *protocol.TCPHeader) uint16 {
+// marshalSegment encodes header and payload as a segment from src to dst
+// and fills in the checksum, which is also stored in header.Checksum.
+func marshalSegment(header *protocol.TCPHeader, payload []byte, src, dst [4]byte) ([]byte, error) {
+	header.Checksum = 0
+	buf, err := header.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize header: %v", err)
+	}
+	buf = append(buf, payload...)
 
-// 	return uint16(0)
-// }
+	header.Checksum = checksum.TCPIPv4(src, dst, buf)
+	binary.BigEndian.PutUint16(buf[16:18], header.Checksum)
+	return buf, nil
+}
 
 func generateRandomSeqNum() uint32 {
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
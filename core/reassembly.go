@@ -0,0 +1,85 @@
+package core
+
+import (
+	"sort"
+	"tcplay/protocol"
+)
+
+// reassembly holds data that arrived ahead of a gap in the sequence space,
+// as non-overlapping blocks sorted by sequence number.
+type reassembly struct {
+	blocks []oooBlock
+	stamp  uint64 // counts insertions
+}
+
+type oooBlock struct {
+	seq   uint32
+	data  []byte
+	stamp uint64 // when the block last grew
+}
+
+func (b oooBlock) end() uint32 {
+	return b.seq + uint32(len(b.data))
+}
+
+// insert adds data starting at seq. Bytes already held are kept, so
+// overlapping and duplicate segments are merged into the existing blocks.
+func (r *reassembly) insert(seq uint32, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	r.stamp++
+	blocks := append(r.blocks, oooBlock{seq: seq, data: append([]byte(nil), data...), stamp: r.stamp})
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return seqLT(blocks[i].seq, blocks[j].seq)
+	})
+
+	merged := blocks[:1]
+	for _, b := range blocks[1:] {
+		last := &merged[len(merged)-1]
+		if seqGT(b.seq, last.end()) {
+			merged = append(merged, b)
+			continue
+		}
+		// b starts inside or right after last: append the part past its end
+		if seqGT(b.end(), last.end()) {
+			last.data = append(last.data, b.data[last.end()-b.seq:]...)
+		}
+		last.stamp = max(last.stamp, b.stamp)
+	}
+	r.blocks = merged
+}
+
+// next removes and returns the data that continues the stream at rcvNxt,
+// or nil if the gap before the first block is still open.
+func (r *reassembly) next(rcvNxt uint32) []byte {
+	for len(r.blocks) > 0 {
+		b := r.blocks[0]
+		if seqGT(b.seq, rcvNxt) {
+			return nil
+		}
+		r.blocks = r.blocks[1:]
+		if seqGT(b.end(), rcvNxt) {
+			return b.data[rcvNxt-b.seq:]
+		}
+		// the block was entirely received already
+	}
+	return nil
+}
+
+// sackBlocks returns up to n of the blocks as SACK blocks, the one that
+// grew last first and the others from most to least recently changed (RFC
+// 2018, section 4).
+func (r *reassembly) sackBlocks(n int) []protocol.SACKBlock {
+	blocks := append([]oooBlock(nil), r.blocks...)
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].stamp > blocks[j].stamp
+	})
+
+	sack := make([]protocol.SACKBlock, 0, min(n, len(blocks)))
+	for _, b := range blocks[:min(n, len(blocks))] {
+		sack = append(sack, protocol.SACKBlock{Left: b.seq, Right: b.end()})
+	}
+	return sack
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"tcplay/protocol"
+)
+
+// Read reads data received on the connection, blocking until some is
+// available. It returns io.EOF once the peer closed its side and all data
+// before the FIN has been read, and os.ErrDeadlineExceeded once the read
+// deadline passed.
+func (c *TCPConnection) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	c.waitLocked(func() bool {
+		return len(c.receiveBuf) > 0 || c.finReceived || c.state == CLOSED || c.readClosed ||
+			c.readDeadline.exceeded(c.cfg.Clock.Now())
+	})
+
+	if c.readClosed {
+		return 0, net.ErrClosed
+	}
+	if c.readDeadline.exceeded(c.cfg.Clock.Now()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if len(c.receiveBuf) == 0 {
+		switch {
+		case c.err != nil:
+			return 0, c.err
+		case c.finReceived:
+			return 0, io.EOF
+		default:
+			return 0, fmt.Errorf("connection closed")
+		}
+	}
+
+	n := copy(b, c.receiveBuf)
+	c.receiveBuf = c.receiveBuf[n:]
+	if len(c.receiveBuf) == 0 {
+		c.receiveBuf = nil
+	}
+
+	if c.synchronized() && c.windowUpdateDue() {
+		c.sendAck()
+	}
+	return n, nil
+}
+
+// synchronized reports whether the peer's initial sequence number is known,
+// so arriving segments can be checked against the receive window.
+func (c *TCPConnection) synchronized() bool {
+	return c.state != CLOSED && c.state != LISTEN && c.state != SYN_SENT
+}
+
+// rcvWnd returns the receive window: the free space in the receive buffer.
+func (c *TCPConnection) rcvWnd() uint32 {
+	return uint32(max(0, c.cfg.ReceiveBufferSize-len(c.receiveBuf)))
+}
+
+// acceptable is the segment acceptability test of RFC 9293, section
+// 3.10.7.4: some part of the segment must fall into the receive window.
+func (c *TCPConnection) acceptable(seg *segment) bool {
+	seq := seg.header.SeqNum
+	segLen := seg.len()
+	wnd := c.rcvWnd()
+
+	inWindow := func(n uint32) bool {
+		return seqLEQ(c.rcvNxt, n) && seqLT(n, c.rcvNxt+wnd)
+	}
+
+	switch {
+	case segLen == 0 && wnd == 0:
+		return seq == c.rcvNxt
+	case segLen == 0:
+		return inWindow(seq)
+	case wnd == 0:
+		return false
+	default:
+		return inWindow(seq) || inWindow(seq+segLen-1)
+	}
+}
+
+// receiveData places the payload of seg into the receive buffer, or into
+// the reassembly queue if it arrived ahead of a gap, and consumes the
+// peer's FIN once everything before it is in. Every segment carrying data
+// or a FIN is acknowledged: in-order data possibly after a delay, anything
+// else right away so that the peer learns about gaps, duplicates and the
+// FIN at once (RFC 5681, section 4.2). c.mu must be held.
+func (c *TCPConnection) receiveData(seg *segment) {
+	now := true
+	defer func() { c.ackReceived(now) }()
+
+	h := seg.header
+	seq := h.SeqNum
+	if h.ControlFlags&protocol.SYN != 0 {
+		seq++
+	}
+	data := seg.payload
+	fin := h.ControlFlags&protocol.FIN != 0
+	c.measureSegment(len(data))
+
+	// Nothing follows the peer's FIN
+	if c.finReceived {
+		return
+	}
+
+	finSeq := seq + uint32(len(data))
+
+	// Trim what was received already
+	if seqLT(seq, c.rcvNxt) {
+		skip := c.rcvNxt - seq
+		if skip >= uint32(len(data)) {
+			data = nil
+		} else {
+			data = data[skip:]
+		}
+		seq = c.rcvNxt
+	}
+
+	// Trim what does not fit the window; a FIN past it is dropped too
+	room := int(c.rcvWnd()) - int(seq-c.rcvNxt)
+	if len(data) > room {
+		data = data[:max(0, room)]
+		fin = false
+	}
+
+	if fin {
+		c.rcvFinPending = true
+		c.rcvFinSeq = finSeq
+	}
+
+	if seq == c.rcvNxt {
+		// Data that fills a gap is acknowledged right away
+		now = len(data) == 0 || len(c.ooo.blocks) > 0
+		c.receiveBuf = append(c.receiveBuf, data...)
+		c.rcvNxt += uint32(len(data))
+		for next := c.ooo.next(c.rcvNxt); next != nil; next = c.ooo.next(c.rcvNxt) {
+			c.receiveBuf = append(c.receiveBuf, next...)
+			c.rcvNxt += uint32(len(next))
+		}
+		if c.readClosed {
+			c.receiveBuf = nil
+		}
+	} else {
+		c.ooo.insert(seq, data)
+	}
+
+	if c.rcvFinPending && c.rcvNxt == c.rcvFinSeq {
+		c.rcvNxt++
+		now = true
+		c.rcvFinPending = false
+		c.finReceived = true
+		if err := c.processEvent(EventRcvFin); err != nil {
+			log.Printf("Ignore FIN: %v", err)
+		}
+	}
+
+	c.notifyLocked()
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"log"
+	"tcplay/core/congestion"
+	"tcplay/protocol"
+)
+
+// dupAckThreshold is the number of duplicate ACKs that signal a loss (RFC
+// 5681, section 3.2).
+const dupAckThreshold = 3
+
+// recovery is the loss recovery state of a connection: NewReno fast
+// retransmit and fast recovery (RFC 6582). How the window reacts is up to
+// the congestion controller; recovery only adds the segments that left the
+// network while it lasts.
+type recovery struct {
+	dupAcks int
+
+	// recover is SND.NXT when the last loss was detected. Fast recovery
+	// lasts until it is acknowledged, and duplicate ACKs below it do not
+	// start another one.
+	recover    uint32
+	inRecovery bool
+
+	// inflation is added to the controller's window during fast recovery,
+	// in bytes. Partial ACKs can make it negative. SACK recovery counts
+	// the pipe instead and leaves it at zero.
+	inflation int64
+
+	// afterRTO is set from a retransmission timeout until everything sent
+	// before it, up to recover, is acknowledged. Meanwhile every segment
+	// not SACKed counts as lost and is resent as the window opens.
+	afterRTO bool
+
+	// highRxt is the end of the last segment retransmitted in this
+	// recovery (HighRxt in RFC 6675).
+	highRxt uint32
+}
+
+// initCongestion creates the congestion controller named in the config for
+// the MSS in use. c.mu must be held.
+func (c *TCPConnection) initCongestion() {
+	mss := uint32(c.maxSegSize)
+	cc, err := congestion.New(c.cfg.CongestionControl, mss)
+	if err != nil {
+		log.Printf("%v, using %s", err, congestion.Reno)
+		cc = congestion.NewReno(mss)
+	}
+	c.cc = cc
+	c.recovery = recovery{recover: c.sndUna}
+}
+
+// cwnd returns the congestion window, inflated during fast recovery.
+func (c *TCPConnection) cwnd() uint32 {
+	wnd := int64(c.cc.Cwnd()) + c.recovery.inflation
+	return uint32(max(wnd, int64(c.maxSegSize)))
+}
+
+// isDupAck reports whether h is a duplicate ACK: it acknowledges nothing
+// new while data is outstanding, and carries no data, SYN, FIN or window
+// change (RFC 5681, section 2). It must be called before h is processed.
+// ACKs of a closed window answer window probes and do not count.
+func (c *TCPConnection) isDupAck(seg *segment) bool {
+	h := seg.header
+	return c.sndNxt != c.sndUna &&
+		h.AckNum == c.sndUna &&
+		len(seg.payload) == 0 &&
+		h.ControlFlags&(protocol.SYN|protocol.FIN) == 0 &&
+		c.peerWindow(h) == c.sndWnd &&
+		c.sndWnd > 0
+}
+
+// onDupAck counts a duplicate ACK. The third one starts fast retransmit
+// and fast recovery; during recovery each one inflates the window by a
+// segment that has left the network. c.mu must be held.
+func (c *TCPConnection) onDupAck() {
+	mss := int64(c.maxSegSize)
+	r := &c.recovery
+	c.stats.DupAcks++
+
+	if r.inRecovery {
+		if !c.sackPermitted {
+			r.inflation += mss
+		}
+		return
+	}
+
+	// With SACK a loss can show before the third duplicate ACK (RFC 6675,
+	// section 5, step 4)
+	r.dupAcks++
+	if len(c.rtx.segments) == 0 {
+		return
+	}
+	if r.dupAcks != dupAckThreshold && !c.rtx.segments[0].lost {
+		return
+	}
+
+	// RFC 6582, section 3.2, step 2: the loss was already dealt with if
+	// the duplicate ACKs are for data sent before the last one
+	if seqLT(c.sndUna, r.recover) {
+		return
+	}
+
+	c.cc.OnLoss(c.sndNxt-c.sndUna, c.cfg.Clock.Now())
+	r.recover = c.sndNxt
+	r.inRecovery = true
+	if !c.sackPermitted {
+		r.inflation = dupAckThreshold * mss
+	}
+
+	first := c.rtx.segments[0]
+	r.highRxt = first.end
+	c.stats.FastRetransmits++
+	log.Printf("Fast retransmit segment %d (cwnd %d)", c.sndUna, c.cwnd())
+	c.retransmit(first)
+}
+
+// onNewAck tells the controller about acked newly acknowledged bytes, or
+// in fast recovery retransmits what a partial ACK shows is missing next.
+// c.mu must be held.
+func (c *TCPConnection) onNewAck(acked uint32) {
+	mss := int64(c.maxSegSize)
+	r := &c.recovery
+	r.dupAcks = 0
+	flight := c.sndNxt - c.sndUna
+	now := c.cfg.Clock.Now()
+
+	if !r.inRecovery {
+		if r.afterRTO && seqGEQ(c.sndUna, r.recover) {
+			r.afterRTO = false
+		}
+		c.cc.OnAck(acked, flight, now)
+		return
+	}
+
+	if seqGEQ(c.sndUna, r.recover) {
+		// Full ACK: deflate the window (RFC 6582, section 3.2, step 3)
+		r.inRecovery = false
+		r.inflation = 0
+		c.cc.OnRecovered(flight, now)
+		return
+	}
+
+	// Partial ACK: the segment after it was lost as well. Deflate by what
+	// it acknowledged and add back one segment.
+	c.stats.PartialAcks++
+	if len(c.rtx.segments) > 0 {
+		first := c.rtx.segments[0]
+		if !c.sackPermitted || seqGEQ(first.header.SeqNum, r.highRxt) {
+			r.highRxt = first.end
+			c.retransmit(first)
+		}
+	}
+	if c.sackPermitted {
+		return
+	}
+	r.inflation -= int64(acked)
+	if int64(acked) >= mss {
+		r.inflation += mss
+	}
+	r.inflation = max(r.inflation, mss-int64(c.cc.Cwnd()))
+}
+
+// onTimeoutCongestion ends fast recovery and lets the controller collapse
+// the window when the retransmission timer expires; first is false if the
+// segment timed out before. Everything outstanding is presumed lost: the
+// timer resends the first segment, output the others as ACKs open the
+// window again. c.mu must be held.
+func (c *TCPConnection) onTimeoutCongestion(first bool) {
+	c.cc.OnRTO(c.sndNxt-c.sndUna, first, c.cfg.Clock.Now())
+	c.recovery = recovery{
+		recover:  c.sndNxt,
+		afterRTO: true,
+		highRxt:  c.rtx.segments[0].end,
+	}
+	c.clearScoreboard()
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+	"tcplay/protocol"
+	"time"
+)
+
+// challengeAckLimit bounds the challenge ACKs a connection sends per second
+// (RFC 5961, section 7).
+const challengeAckLimit = 10
+
+// ConnectionResetError is reported to every caller blocked on a connection
+// once it was reset, by a RST from the peer or by Abort.
+type ConnectionResetError struct {
+	Local   bool // Abort was called
+	Refused bool // the RST answered our SYN
+}
+
+func (e *ConnectionResetError) Error() string {
+	switch {
+	case e.Local:
+		return "connection aborted"
+	case e.Refused:
+		return "connection refused"
+	default:
+		return "connection reset by peer"
+	}
+}
+
+// Unwrap lets errors.Is match the errno the kernel would report.
+func (e *ConnectionResetError) Unwrap() error {
+	switch {
+	case e.Local:
+		return syscall.ECONNABORTED
+	case e.Refused:
+		return syscall.ECONNREFUSED
+	default:
+		return syscall.ECONNRESET
+	}
+}
+
+// Abort resets the connection immediately: queued and unacknowledged data
+// is dropped, the peer gets a RST if it knows about the connection, and
+// every blocked Read and SendMessage returns a ConnectionResetError.
+func (c *TCPConnection) Abort() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == CLOSED {
+		return c.err
+	}
+
+	// RFC 9293, section 3.10.5
+	switch c.state {
+	case SYN_RECEIVED, ESTABLISHED, FIN_WAIT_1, FIN_WAIT_2, CLOSE_WAIT:
+		c.sendRst(c.sndNxt)
+	}
+
+	c.reset(EventAbort, &ConnectionResetError{Local: true})
+	return nil
+}
+
+// handleRst processes a RST that passed the window check (RFC 5961, section
+// 3.2): only one exactly at RCV.NXT resets the connection, any other gets a
+// challenge ACK, so a blind attacker has to guess the sequence number
+// exactly. c.mu must be held.
+func (c *TCPConnection) handleRst(h *protocol.TCPHeader) error {
+	if h.SeqNum != c.rcvNxt {
+		c.sendChallengeAck()
+		return fmt.Errorf("RST %d is not at RCV.NXT %d", h.SeqNum, c.rcvNxt)
+	}
+
+	// A RST in TIME_WAIT would cut the wait short (RFC 1337)
+	if c.state == TIME_WAIT {
+		return fmt.Errorf("RST ignored in TIME_WAIT")
+	}
+
+	c.reset(EventRcvRst, &ConnectionResetError{})
+	return nil
+}
+
+// reset tears the connection down with a ConnectionResetError. Data not
+// read yet is dropped. c.mu must be held.
+func (c *TCPConnection) reset(ev Event, err error) {
+	c.receiveBuf = nil
+	c.sendBuf = nil
+	c.teardown(ev, err)
+}
+
+// sendRst sends <SEQ=seq><CTL=RST>. c.mu must be held.
+func (c *TCPConnection) sendRst(seq uint32) {
+	rstHeader := &protocol.TCPHeader{
+		SourcePort:   c.srcPort,
+		DestPort:     c.destPort,
+		SeqNum:       seq,
+		ControlFlags: protocol.RST,
+		HeaderLen:    5,
+	}
+
+	if err := c.sendPacket(rstHeader); err != nil {
+		log.Printf("Failed to send RST: %v", err)
+	}
+}
+
+// sendChallengeAck answers a suspicious RST, SYN or ACK with an ACK for
+// what we expect (RFC 5961). A peer that really lost the connection answers
+// it with a RST at the right sequence number.
+func (c *TCPConnection) sendChallengeAck() {
+	now := c.cfg.Clock.Now()
+	if now.Sub(c.challengeStart) >= time.Second {
+		c.challengeStart = now
+		c.challengeAcks = 0
+	}
+	if c.challengeAcks >= challengeAckLimit {
+		return
+	}
+	c.challengeAcks++
+	c.sendAck()
+}
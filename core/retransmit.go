@@ -0,0 +1,286 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"tcplay/components/clock"
+	"tcplay/protocol"
+	"time"
+)
+
+const (
+	// initialRTO is used until the first RTT sample (RFC 6298, section 2.1).
+	initialRTO = 1 * time.Second
+
+	// synFallbackRTO is used when the SYN had to be retransmitted and no RTT
+	// sample was taken (RFC 6298, section 5.7).
+	synFallbackRTO = 3 * time.Second
+
+	// clockGranularity is G in the RTO formula.
+	clockGranularity = time.Millisecond
+)
+
+// TimeoutError is returned when a segment was retransmitted MaxRetries times
+// without being acknowledged.
+type TimeoutError struct {
+	Retries int
+	Seq     uint32
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("connection timed out: segment %d not acknowledged after %d retransmissions", e.Seq, e.Retries)
+}
+
+// Timeout lets TimeoutError satisfy net.Error.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary lets TimeoutError satisfy net.Error.
+func (e *TimeoutError) Temporary() bool { return false }
+
+// rtoEstimator computes the retransmission timeout from RTT samples as
+// described in RFC 6298.
+type rtoEstimator struct {
+	srtt      time.Duration
+	rttvar    time.Duration
+	rto       time.Duration
+	hasSample bool
+	minRTO    time.Duration
+	maxRTO    time.Duration
+}
+
+func newRTOEstimator(cfg Config) *rtoEstimator {
+	return &rtoEstimator{
+		rto:    initialRTO,
+		minRTO: cfg.MinRTO,
+		maxRTO: cfg.MaxRTO,
+	}
+}
+
+// sample updates SRTT, RTTVAR and RTO with a new RTT measurement.
+func (e *rtoEstimator) sample(rtt time.Duration) {
+	if !e.hasSample {
+		// (2.2) first measurement
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.hasSample = true
+	} else {
+		// (2.3) RTTVAR <- 3/4 * RTTVAR + 1/4 * |SRTT - R'|
+		//       SRTT   <- 7/8 * SRTT + 1/8 * R'
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+
+	e.rto = e.srtt + max(clockGranularity, 4*e.rttvar)
+	e.clamp()
+}
+
+// backoff doubles the RTO after a timeout (RFC 6298, section 5.5).
+func (e *rtoEstimator) backoff() {
+	e.rto *= 2
+	e.clamp()
+}
+
+func (e *rtoEstimator) clamp() {
+	if e.rto < e.minRTO {
+		e.rto = e.minRTO
+	}
+	if e.rto > e.maxRTO {
+		e.rto = e.maxRTO
+	}
+}
+
+// rtxSegment is a sent segment waiting to be acknowledged.
+type rtxSegment struct {
+	header        *protocol.TCPHeader
+	payload       []byte
+	end           uint32 // sequence number following the segment
+	sentAt        time.Time
+	retransmitted bool
+
+	// The SACK scoreboard, see updateScoreboard
+	sacked bool
+	lost   bool
+}
+
+// retransmitQueue holds the unacknowledged segments of a connection in
+// sequence order, with a single timer for the oldest one.
+type retransmitQueue struct {
+	segments []*rtxSegment
+	timer    connTimer
+	rto      *rtoEstimator
+	retries  int
+}
+
+// sendReliable sends a segment that occupies sequence space, advances
+// SND.NXT past it and keeps it for retransmission until it is acknowledged.
+// c.mu must be held.
+func (c *TCPConnection) sendReliable(header *protocol.TCPHeader, payload []byte) error {
+	if err := c.transmit(header, payload); err != nil {
+		return err
+	}
+
+	end := header.SeqNum + uint32(len(payload)) + controlLen(header)
+	if seqGT(end, c.sndNxt) {
+		c.sndNxt = end
+	}
+
+	c.rtx.segments = append(c.rtx.segments, &rtxSegment{
+		header:  header,
+		payload: payload,
+		end:     end,
+		sentAt:  c.cfg.Clock.Now(),
+	})
+
+	// (5.1) start the timer if it is not running
+	if !c.rtx.timer.running() {
+		c.startRetransmitTimer()
+	}
+	return nil
+}
+
+// transmit puts a segment on the wire.
+func (c *TCPConnection) transmit(header *protocol.TCPHeader, payload []byte) error {
+	if len(payload) == 0 {
+		return c.sendPacket(header)
+	}
+	return c.sendPacketWithPayload(header, payload)
+}
+
+// handleAck advances SND.UNA, releases acknowledged data from the send
+// buffer, drops every segment the ACK in h covers, takes an RTT sample and
+// manages the timer. c.mu must be held.
+func (c *TCPConnection) handleAck(h *protocol.TCPHeader) {
+	ack := h.AckNum
+	if seqGT(ack, c.sndUna) && seqLEQ(ack, c.sndNxt) {
+		// The SYN and FIN are not in the send buffer
+		acked := min(int(ack-c.sndUna), len(c.sendBuf))
+		c.sendBuf = c.sendBuf[acked:]
+		c.sndUna = ack
+		c.notifyLocked()
+	}
+
+	q := c.rtx
+	acked := 0
+	var newest *rtxSegment
+	ambiguous := false
+	for _, s := range q.segments {
+		if !seqLEQ(s.end, ack) {
+			break
+		}
+		acked++
+		newest = s
+		ambiguous = ambiguous || s.retransmitted
+	}
+	if acked == 0 {
+		return
+	}
+
+	// With timestamps every ACK of new data is timed by the TSval it echoes,
+	// which dates the transmission that arrived, retransmitted or not, and
+	// counts the time the peer held a delayed ACK (RFC 7323, section 4).
+	// Without them, Karn's algorithm: never time a segment that was
+	// retransmitted.
+	switch {
+	case c.ts.ok:
+		if rtt, ok := c.timestampRTT(h); ok {
+			c.sampleRTT(rtt)
+		}
+	case !ambiguous:
+		c.sampleRTT(clock.Since(c.cfg.Clock, newest.sentAt))
+	}
+
+	q.segments = q.segments[acked:]
+	q.retries = 0
+
+	c.stopRetransmitTimer()
+	if len(q.segments) > 0 {
+		// (5.3) restart the timer for the remaining data
+		c.startRetransmitTimer()
+	}
+}
+
+// sampleRTT feeds an RTT measurement to the RTO estimator and the
+// congestion controller. c.mu must be held.
+func (c *TCPConnection) sampleRTT(rtt time.Duration) {
+	c.rtx.rto.sample(rtt)
+	c.cc.OnRTTSample(rtt, c.cfg.Clock.Now())
+}
+
+func (c *TCPConnection) startRetransmitTimer() {
+	c.arm(&c.rtx.timer, c.rtx.rto.rto, c.onRetransmitTimeout)
+}
+
+func (c *TCPConnection) stopRetransmitTimer() {
+	c.rtx.timer.stop()
+}
+
+// onRetransmitTimeout resends the oldest unacknowledged segment with a
+// backed-off timer, or gives up after MaxRetries. c.mu must be held.
+func (c *TCPConnection) onRetransmitTimeout() {
+	q := c.rtx
+	if len(q.segments) == 0 {
+		return
+	}
+
+	first := q.segments[0]
+	if q.retries >= c.cfg.MaxRetries {
+		c.fail(&TimeoutError{Retries: q.retries, Seq: first.header.SeqNum})
+		return
+	}
+
+	if c.synchronized() {
+		c.onTimeoutCongestion(q.retries == 0)
+	}
+
+	q.retries++
+	q.rto.backoff()
+	c.stats.Timeouts++
+	log.Printf("Retransmit segment %d (attempt %d, RTO %v)", first.header.SeqNum, q.retries, q.rto.rto)
+
+	c.retransmit(first)
+	c.startRetransmitTimer()
+}
+
+// retransmit sends s again. It is never used for an RTT sample after this
+// (Karn's algorithm). c.mu must be held.
+func (c *TCPConnection) retransmit(s *rtxSegment) {
+	s.retransmitted = true
+	c.stats.Retransmits++
+	c.refreshHeader(s.header)
+	if err := c.transmit(s.header, s.payload); err != nil {
+		log.Printf("Failed to retransmit segment: %v", err)
+	}
+}
+
+// refreshHeader brings the acknowledgment, window and SACK blocks of a
+// segment that is sent again up to date. The timestamps are stamped anew
+// anyway. c.mu must be held.
+func (c *TCPConnection) refreshHeader(h *protocol.TCPHeader) {
+	if h.ControlFlags&protocol.ACK != 0 {
+		h.AckNum = c.rcvNxt
+	}
+	if h.ControlFlags&protocol.SYN != 0 {
+		h.WindowSize = c.synWindow()
+		return
+	}
+
+	h.WindowSize = c.advertisedWindow()
+	h.Options = nil
+	if opt := c.sackOption(c.timestampsLen()); opt != nil {
+		h.Options = append(h.Options, opt)
+	}
+}
+
+// synDone is called once the handshake completes. If the SYN had to be
+// retransmitted without any RTT sample, the RTO falls back to 3 seconds
+// (RFC 6298, section 5.7).
+func (c *TCPConnection) synDone() {
+	if !c.rtx.rto.hasSample && c.rtx.rto.rto > initialRTO {
+		c.rtx.rto.rto = synFallbackRTO
+		c.rtx.rto.clamp()
+	}
+}
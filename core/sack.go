@@ -0,0 +1,136 @@
+package core
+
+import (
+	"log"
+	"tcplay/protocol"
+)
+
+// maxSACKBlocks is how many blocks fit into the option space next to
+// nothing else (RFC 2018, section 3).
+const maxSACKBlocks = (protocol.MaxOptionsLen - 2) / 8
+
+// sackOption returns the SACK option reporting the data held in the
+// reassembly queue, or nil if there is none or SACK was not negotiated.
+// used is the option space other options already take. c.mu must be held.
+func (c *TCPConnection) sackOption(used int) protocol.Option {
+	if !c.sackPermitted || len(c.ooo.blocks) == 0 {
+		return nil
+	}
+	n := min(maxSACKBlocks, (protocol.MaxOptionsLen-used-2)/8)
+	if n <= 0 {
+		return nil
+	}
+	return protocol.SACKOption{Blocks: c.ooo.sackBlocks(n)}
+}
+
+// updateScoreboard marks the segments in the retransmission queue that the
+// SACK blocks of h cover, and which of the rest are lost: those with at
+// least dupAckThreshold SACKed segments or more than dupAckThreshold-1
+// segments' worth of SACKed bytes above them (RFC 6675, section 4,
+// IsLost). It must be called after handleAck. c.mu must be held.
+func (c *TCPConnection) updateScoreboard(h *protocol.TCPHeader) {
+	if !c.sackPermitted {
+		return
+	}
+	opt, ok := h.Option(protocol.OptionSACK).(protocol.SACKOption)
+	if !ok {
+		return
+	}
+
+	segs := c.rtx.segments
+	for _, b := range opt.Blocks {
+		// Blocks below SND.UNA (D-SACK) or beyond SND.NXT tell us nothing
+		if !seqLT(b.Left, b.Right) || seqLT(b.Left, c.sndUna) || seqGT(b.Right, c.sndNxt) {
+			continue
+		}
+		for _, s := range segs {
+			if seqGEQ(s.header.SeqNum, b.Left) && seqLEQ(s.end, b.Right) {
+				s.sacked = true
+			}
+		}
+	}
+
+	sackedSegs := 0
+	sackedBytes := uint32(0)
+	lostBytes := (dupAckThreshold - 1) * uint32(c.maxSegSize)
+	for i := len(segs) - 1; i >= 0; i-- {
+		s := segs[i]
+		if s.sacked {
+			s.lost = false
+			sackedSegs++
+			sackedBytes += s.end - s.header.SeqNum
+			continue
+		}
+		s.lost = s.lost || sackedSegs >= dupAckThreshold || sackedBytes > lostBytes
+	}
+}
+
+// clearScoreboard presumes every outstanding segment lost, SACKed or not.
+// The peer may have reneged on data it SACKed (RFC 2018, section 8), so
+// after a retransmission timeout the scoreboard is rebuilt from the SACK
+// blocks that arrive from then on (RFC 6675, section 5.1). c.mu must be
+// held.
+func (c *TCPConnection) clearScoreboard() {
+	for _, s := range c.rtx.segments {
+		s.sacked = false
+		s.lost = true
+	}
+}
+
+// scoreboardRecovery reports whether what is resent is chosen from the
+// scoreboard, and the window measured against the pipe: in SACK recovery
+// (RFC 6675) rather than NewReno's, and after a retransmission timeout.
+func (c *TCPConnection) scoreboardRecovery() bool {
+	r := c.recovery
+	return r.afterRTO || (c.sackPermitted && r.inRecovery)
+}
+
+// pipe estimates the bytes in flight during SACK recovery: every segment
+// neither SACKed nor lost, plus every retransmission (RFC 6675, section 4,
+// SetPipe).
+func (c *TCPConnection) pipe() uint32 {
+	pipe := uint32(0)
+	for _, s := range c.rtx.segments {
+		if s.sacked {
+			continue
+		}
+		n := s.end - s.header.SeqNum
+		if !s.lost {
+			pipe += n
+		}
+		if seqLT(s.header.SeqNum, c.recovery.highRxt) {
+			pipe += n
+		}
+	}
+	return pipe
+}
+
+// nextLost returns the first segment presumed lost that was not
+// retransmitted in this recovery yet (RFC 6675, section 4, NextSeg rule 1).
+func (c *TCPConnection) nextLost() *rtxSegment {
+	for _, s := range c.rtx.segments {
+		if s.lost && !s.sacked && seqGEQ(s.header.SeqNum, c.recovery.highRxt) {
+			return s
+		}
+	}
+	return nil
+}
+
+// retransmitLost resends the holes in the scoreboard while the congestion
+// window admits them and reports whether it is still holding back lost data.
+// c.mu must be held.
+func (c *TCPConnection) retransmitLost() bool {
+	mss := uint32(c.maxSegSize)
+	for {
+		s := c.nextLost()
+		if s == nil {
+			return false
+		}
+		if pipe := c.pipe(); pipe+mss > c.cwnd() || c.sndWnd == 0 {
+			return true
+		}
+		log.Printf("Retransmit lost segment %d", s.header.SeqNum)
+		c.recovery.highRxt = s.end
+		c.retransmit(s)
+	}
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"tcplay/protocol"
+)
+
+// SendMessage queues data on the send buffer and sends it in segments of at
+// most maxSegSize bytes. It blocks while the send buffer is full, so writes
+// of any size work; it returns once all of data is queued.
+func (c *TCPConnection) SendMessage(data []byte) error {
+	_, err := c.Write(data)
+	return err
+}
+
+// Write is SendMessage for io.Writer and net.Conn: it also reports how much
+// of b was queued before an error or the write deadline stopped it.
+func (c *TCPConnection) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.readClosed {
+			return written, net.ErrClosed
+		}
+		if c.finQueued {
+			return written, fmt.Errorf("connection closed for writing")
+		}
+		if !c.canSend() {
+			return written, fmt.Errorf("connection is not established")
+		}
+		if c.writeDeadline.exceeded(c.cfg.Clock.Now()) {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		space := c.cfg.SendBufferSize - len(c.sendBuf)
+		if space <= 0 {
+			c.waitLocked(func() bool {
+				return len(c.sendBuf) < c.cfg.SendBufferSize || !c.canSend() || c.writeDeadline.exceeded(c.cfg.Clock.Now())
+			})
+			continue
+		}
+
+		n := min(space, len(b)-written)
+		c.sendBuf = append(c.sendBuf, b[written:written+n]...)
+		written += n
+
+		if err := c.output(); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// canSend reports whether the state still allows sending data.
+func (c *TCPConnection) canSend() bool {
+	return c.state == ESTABLISHED || c.state == CLOSE_WAIT
+}
+
+// canOutput reports whether queued data and our FIN may still go out:
+// after Close that is until the FIN is sent.
+func (c *TCPConnection) canOutput() bool {
+	switch c.state {
+	case ESTABLISHED, CLOSE_WAIT, FIN_WAIT_1, CLOSING, LAST_ACK:
+		return true
+	}
+	return false
+}
+
+// output sends the part of the send buffer past SND.NXT, cut into segments
+// of at most maxSegSize bytes, as far as the windows and the pacing rate
+// admit. Segments shorter than that may wait for more data, see holdBack.
+// PSH is set on the segment that empties the buffer; a queued FIN
+// follows it. c.mu must be held.
+func (c *TCPConnection) output() error {
+	// Holes in the scoreboard go before new data
+	if c.scoreboardRecovery() && c.retransmitLost() {
+		return nil
+	}
+
+	for {
+		unsent := c.unsent()
+		if len(unsent) == 0 {
+			if c.finQueued && !c.finSent {
+				return c.sendFin()
+			}
+			return nil
+		}
+
+		inFlight := c.sndNxt != c.sndUna
+		usable := int(c.usableWindow())
+		if usable == 0 {
+			if !inFlight {
+				c.startPersistTimer()
+			}
+			return nil
+		}
+
+		n := min(len(unsent), int(c.maxSegSize), usable)
+		small := n < int(c.maxSegSize)
+		if small && c.holdBack(n, len(unsent)) {
+			return nil
+		}
+
+		if c.paced() {
+			return nil
+		}
+		if err := c.sendData(unsent[:n], n == len(unsent)); err != nil {
+			return err
+		}
+		if small {
+			c.sndSml = c.sndNxt
+		}
+		c.pace(n)
+	}
+}
+
+// unsent returns the part of the send buffer past SND.NXT.
+func (c *TCPConnection) unsent() []byte {
+	sent := int(c.sndNxt - c.sndUna)
+	if sent >= len(c.sendBuf) {
+		return nil
+	}
+	return c.sendBuf[sent:]
+}
+
+// sendData sends data as the segment starting at SND.NXT. c.mu must be held.
+func (c *TCPConnection) sendData(data []byte, push bool) error {
+	payload := make([]byte, len(data))
+	copy(payload, data)
+
+	flags := uint8(protocol.ACK)
+	if push {
+		flags |= protocol.PSH
+	}
+
+	dataHeader := &protocol.TCPHeader{
+		SourcePort:   c.srcPort,
+		DestPort:     c.destPort,
+		SeqNum:       c.sndNxt,
+		AckNum:       c.rcvNxt,
+		ControlFlags: flags,
+		WindowSize:   c.advertisedWindow(),
+		HeaderLen:    5,
+	}
+
+	if err := c.sendReliable(dataHeader, payload); err != nil {
+		return fmt.Errorf("failed to send packet with payload: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package core
+
+// Sequence numbers wrap around at 2^32, so they are compared with modular
+// arithmetic (RFC 9293, section 3.4).
+
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+func seqGT(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func seqGEQ(a, b uint32) bool {
+	return int32(a-b) >= 0
+}
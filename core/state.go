@@ -0,0 +1,309 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"tcplay/protocol"
+)
+
+// TCP Connection State Diagram (RFC 793, Figure 6)
+//
+//                               +---------+ ---------\      active OPEN
+//                               |  CLOSED |            \    -----------
+//                               +---------+<---------\   \   create TCB
+//                                 |     ^              \   \  snd SYN
+//                    passive OPEN |     |   CLOSE        \   \
+//                    ------------ |     | ----------       \   \
+//                     create TCB  |     | delete TCB         \   \
+//                                 V     |                      \   \
+//                               +---------+            CLOSE    |    \
+//                               |  LISTEN |          ---------- |     |
+//                               +---------+          delete TCB |     |
+//                    rcv SYN      |     |     SEND              |     |
+//                   -----------   |     |    -------            |     V
+//  +---------+      snd SYN,ACK  /       \   snd SYN          +---------+
+//  |         |<-----------------           ------------------>|         |
+//  |   SYN   |                    rcv SYN                     |   SYN   |
+//  |   RCVD  |<-----------------------------------------------|   SENT  |
+//  |         |                    snd ACK                     |         |
+//  |         |------------------           -------------------|         |
+//  +---------+   rcv ACK of SYN  \       /  rcv SYN,ACK       +---------+
+//    |           --------------   |     |   -----------
+//    |                  x         |     |     snd ACK
+//    |                            V     V
+//    |  CLOSE                   +---------+
+//    | -------                  |  ESTAB  |
+//    | snd FIN                  +---------+
+//    |                   CLOSE    |     |    rcv FIN
+//    V                  -------   |     |    -------
+//  +---------+          snd FIN  /       \   snd ACK          +---------+
+//  |  FIN    |<-----------------           ------------------>|  CLOSE  |
+//  | WAIT-1  |------------------                              |   WAIT  |
+//  +---------+          rcv FIN  \                            +---------+
+//    | rcv ACK of FIN   -------   |                            CLOSE  |
+//    | --------------   snd ACK   |                           ------- |
+//    V        x                   V                           snd FIN V
+//  +---------+                  +---------+                   +---------+
+//  |FINWAIT-2|                  | CLOSING |                   | LAST-ACK|
+//  +---------+                  +---------+                   +---------+
+//    |                rcv ACK of FIN |                 rcv ACK of FIN |
+//    |  rcv FIN       -------------- |    Timeout=2MSL -------------- |
+//    |  -------              x       V    ------------        x       V
+//     \ snd ACK                 +---------+delete TCB         +---------+
+//      ------------------------>|TIME WAIT|------------------>| CLOSED  |
+//                               +---------+                   +---------+
+
+// State is the state of a TCP connection.
+type State uint8
+
+const (
+	CLOSED State = iota
+	LISTEN
+	SYN_SENT
+	SYN_RECEIVED
+	ESTABLISHED
+	FIN_WAIT_1
+	FIN_WAIT_2
+	CLOSE_WAIT
+	CLOSING
+	LAST_ACK
+	TIME_WAIT
+)
+
+var stateNames = [...]string{
+	CLOSED:       "CLOSED",
+	LISTEN:       "LISTEN",
+	SYN_SENT:     "SYN_SENT",
+	SYN_RECEIVED: "SYN_RECEIVED",
+	ESTABLISHED:  "ESTABLISHED",
+	FIN_WAIT_1:   "FIN_WAIT_1",
+	FIN_WAIT_2:   "FIN_WAIT_2",
+	CLOSE_WAIT:   "CLOSE_WAIT",
+	CLOSING:      "CLOSING",
+	LAST_ACK:     "LAST_ACK",
+	TIME_WAIT:    "TIME_WAIT",
+}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("State(%d)", uint8(s))
+}
+
+// Event is something that drives the connection from one state to another:
+// either a user call or an arriving segment.
+type Event uint8
+
+const (
+	EventPassiveOpen Event = iota // user called Listen
+	EventActiveOpen               // user called Connect, SYN sent
+	EventSend                     // user sent data on a listening connection, SYN sent
+	EventClose                    // user called Close
+	EventRcvSyn                   // SYN without ACK
+	EventRcvSynAck                // SYN together with ACK
+	EventRcvAck                   // ACK that does not acknowledge our FIN
+	EventRcvAckOfFin              // ACK that acknowledges our FIN
+	EventRcvFin                   // FIN, once all data before it arrived
+	EventRcvRst                   // RST
+	EventTimeout                  // 2MSL, retransmission or user timeout
+	EventAbort                    // user called Abort
+)
+
+var eventNames = [...]string{
+	EventPassiveOpen: "passive OPEN",
+	EventActiveOpen:  "active OPEN",
+	EventSend:        "SEND",
+	EventClose:       "CLOSE",
+	EventRcvSyn:      "rcv SYN",
+	EventRcvSynAck:   "rcv SYN,ACK",
+	EventRcvAck:      "rcv ACK",
+	EventRcvAckOfFin: "rcv ACK of FIN",
+	EventRcvFin:      "rcv FIN",
+	EventRcvRst:      "rcv RST",
+	EventTimeout:     "timeout",
+	EventAbort:       "ABORT",
+}
+
+func (e Event) String() string {
+	if int(e) < len(eventNames) {
+		return eventNames[e]
+	}
+	return fmt.Sprintf("Event(%d)", uint8(e))
+}
+
+// transitions lists every legal (state, event) pair and the state it leads
+// to. Anything not in the table is rejected by Transition.
+var transitions = map[State]map[Event]State{
+	CLOSED: {
+		EventPassiveOpen: LISTEN,
+		EventActiveOpen:  SYN_SENT,
+	},
+	LISTEN: {
+		EventRcvSyn: SYN_RECEIVED,
+		EventSend:   SYN_SENT,
+		EventClose:  CLOSED,
+		EventRcvRst: LISTEN, // a RST in LISTEN is ignored
+		EventAbort:  CLOSED,
+	},
+	SYN_SENT: {
+		EventRcvSyn:    SYN_RECEIVED, // simultaneous open
+		EventRcvSynAck: ESTABLISHED,
+		EventClose:     CLOSED,
+		EventRcvRst:    CLOSED,
+		EventTimeout:   CLOSED,
+		EventAbort:     CLOSED,
+	},
+	SYN_RECEIVED: {
+		EventRcvSyn:  SYN_RECEIVED, // retransmitted SYN
+		EventRcvAck:  ESTABLISHED,
+		EventRcvFin:  CLOSE_WAIT,
+		EventClose:   FIN_WAIT_1,
+		EventRcvRst:  CLOSED,
+		EventTimeout: CLOSED,
+		EventAbort:   CLOSED,
+	},
+	ESTABLISHED: {
+		EventRcvSynAck: ESTABLISHED, // our ACK of the SYN,ACK was lost
+		EventRcvAck:    ESTABLISHED,
+		EventRcvFin:    CLOSE_WAIT,
+		EventClose:     FIN_WAIT_1,
+		EventRcvRst:    CLOSED,
+		EventTimeout:   CLOSED,
+		EventAbort:     CLOSED,
+	},
+	FIN_WAIT_1: {
+		EventRcvAck:      FIN_WAIT_1,
+		EventRcvAckOfFin: FIN_WAIT_2,
+		EventRcvFin:      CLOSING, // simultaneous close
+		EventRcvRst:      CLOSED,
+		EventTimeout:     CLOSED,
+		EventAbort:       CLOSED,
+	},
+	FIN_WAIT_2: {
+		EventRcvAck:      FIN_WAIT_2,
+		EventRcvAckOfFin: FIN_WAIT_2,
+		EventRcvFin:      TIME_WAIT,
+		EventRcvRst:      CLOSED,
+		EventTimeout:     CLOSED,
+		EventAbort:       CLOSED,
+	},
+	CLOSE_WAIT: {
+		EventRcvAck:  CLOSE_WAIT,
+		EventRcvFin:  CLOSE_WAIT, // retransmitted FIN
+		EventClose:   LAST_ACK,
+		EventRcvRst:  CLOSED,
+		EventTimeout: CLOSED,
+		EventAbort:   CLOSED,
+	},
+	CLOSING: {
+		EventRcvAck:      CLOSING,
+		EventRcvAckOfFin: TIME_WAIT,
+		EventRcvFin:      CLOSING,
+		EventRcvRst:      CLOSED,
+		EventTimeout:     CLOSED,
+		EventAbort:       CLOSED,
+	},
+	LAST_ACK: {
+		EventRcvAck:      LAST_ACK,
+		EventRcvAckOfFin: CLOSED,
+		EventRcvFin:      LAST_ACK,
+		EventRcvRst:      CLOSED,
+		EventTimeout:     CLOSED,
+		EventAbort:       CLOSED,
+	},
+	TIME_WAIT: {
+		EventRcvAck:      TIME_WAIT,
+		EventRcvAckOfFin: TIME_WAIT,
+		EventRcvFin:      TIME_WAIT, // retransmitted FIN, ACK it again
+		EventRcvRst:      TIME_WAIT, // RFC 1337: no TIME_WAIT assassination
+		EventTimeout:     CLOSED,
+		EventAbort:       CLOSED,
+	},
+}
+
+// TransitionError is returned when an event is not allowed in the current state.
+type TransitionError struct {
+	State State
+	Event Event
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("illegal transition: %s in state %s", e.Event, e.State)
+}
+
+// Transition returns the state reached by applying ev in state s.
+func Transition(s State, ev Event) (State, error) {
+	next, ok := transitions[s][ev]
+	if !ok {
+		return s, &TransitionError{State: s, Event: ev}
+	}
+	return next, nil
+}
+
+// State returns the current state of the connection.
+func (c *TCPConnection) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// processEvent is the only place where c.state changes. It validates the
+// event against the transition table and leaves the state untouched if the
+// event is illegal. c.mu must be held.
+func (c *TCPConnection) processEvent(ev Event) error {
+	next, err := Transition(c.state, ev)
+	if err != nil {
+		return err
+	}
+
+	if next != c.state {
+		log.Printf("State %s -> %s (%s)", c.state, next, ev)
+		c.state = next
+		c.notifyLocked()
+
+		switch next {
+		case FIN_WAIT_2:
+			if c.readClosed {
+				c.startTimeWait()
+			}
+		case TIME_WAIT:
+			c.startTimeWait()
+		case CLOSED:
+			c.release()
+		}
+	}
+	return nil
+}
+
+// segmentEvent maps the control flags and acknowledgment of an arriving
+// segment to the event it represents in the current state. A FIN is not
+// part of it: it is only processed once the data before it has arrived,
+// see receiveData.
+func (c *TCPConnection) segmentEvent(h *protocol.TCPHeader) (Event, error) {
+	flags := h.ControlFlags
+
+	switch {
+	case flags&protocol.RST != 0:
+		return EventRcvRst, nil
+	case flags&protocol.SYN != 0 && flags&protocol.ACK != 0:
+		if c.state == SYN_SENT && h.AckNum != c.iss+1 {
+			return 0, fmt.Errorf("SYN,ACK acknowledges %d, expected %d", h.AckNum, c.iss+1)
+		}
+		return EventRcvSynAck, nil
+	case flags&protocol.SYN != 0:
+		return EventRcvSyn, nil
+	case flags&protocol.ACK == 0:
+		return 0, fmt.Errorf("segment without ACK (flags %#x)", flags)
+	}
+
+	// In SYN_RECEIVED the only acceptable ACK is the one for our SYN
+	if c.state == SYN_RECEIVED && h.AckNum != c.iss+1 {
+		return 0, fmt.Errorf("ACK acknowledges %d, expected %d", h.AckNum, c.iss+1)
+	}
+
+	if c.finSent && h.AckNum == c.finSeq+1 {
+		return EventRcvAckOfFin, nil
+	}
+	return EventRcvAck, nil
+}
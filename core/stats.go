@@ -0,0 +1,17 @@
+package core
+
+// Stats counts events in the life of a connection.
+type Stats struct {
+	Retransmits     int // segments sent again, for any reason
+	Timeouts        int // expirations of the retransmission timer
+	DupAcks         int // duplicate ACKs received
+	FastRetransmits int // losses detected by duplicate ACKs
+	PartialAcks     int // ACKs in fast recovery that showed another loss
+}
+
+// Stats returns the counters of the connection.
+func (c *TCPConnection) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
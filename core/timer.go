@@ -0,0 +1,46 @@
+package core
+
+import (
+	"tcplay/components/clock"
+	"time"
+)
+
+// connTimer is a timer of a connection. Its function runs with c.mu held,
+// and only if the timer is still the one armed: a call that fired while
+// the timer was being stopped or re-armed, and waited for c.mu meanwhile,
+// finds itself stale and does nothing.
+type connTimer struct {
+	t   clock.Timer
+	gen uint64 // counts arms, identifies the current one
+}
+
+// arm starts tm to call fn after d, replacing the call pending, if any.
+// c.mu must be held.
+func (c *TCPConnection) arm(tm *connTimer, d time.Duration, fn func()) {
+	tm.stop()
+	tm.gen++
+	gen := tm.gen
+	tm.t = c.cfg.Clock.AfterFunc(d, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if tm.t == nil || tm.gen != gen {
+			return
+		}
+		tm.t = nil
+		fn()
+	})
+}
+
+// stop cancels the pending call. c.mu must be held.
+func (tm *connTimer) stop() {
+	if tm.t != nil {
+		tm.t.Stop()
+		tm.t = nil
+	}
+}
+
+// running reports whether a call is pending. c.mu must be held.
+func (tm *connTimer) running() bool {
+	return tm.t != nil
+}
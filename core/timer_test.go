@@ -0,0 +1,45 @@
+package core
+
+import (
+	"tcplay/components/clock"
+	"testing"
+	"time"
+)
+
+func TestStaleTimerCallDoesNothing(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	c := newConnection(clientIP, 40000, serverIP, 80, Config{Clock: clk})
+
+	var tm connTimer
+	var calls []string
+	c.mu.Lock()
+	c.arm(&tm, time.Second, func() { calls = append(calls, "first") })
+	c.mu.Unlock()
+
+	// The first call fires and waits for c.mu while the timer is re-armed
+	c.mu.Lock()
+	fired := make(chan struct{})
+	go func() {
+		clk.Advance(time.Second)
+		close(fired)
+	}()
+	for clk.Pending() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.arm(&tm, time.Second, func() { calls = append(calls, "second") })
+	c.mu.Unlock()
+	<-fired
+
+	c.mu.Lock()
+	if len(calls) != 0 || !tm.running() {
+		t.Fatalf("stale call ran: calls %v, timer running %v", calls, tm.running())
+	}
+	c.mu.Unlock()
+
+	clk.Advance(time.Second)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(calls) != 1 || calls[0] != "second" || tm.running() {
+		t.Fatalf("calls %v, timer running %v; want the second call only", calls, tm.running())
+	}
+}
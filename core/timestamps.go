@@ -0,0 +1,129 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"tcplay/protocol"
+	"time"
+)
+
+const (
+	// tsTick is the period of the timestamp clock (RFC 7323, section 5.4).
+	tsTick = time.Millisecond
+
+	// pawsIdle is how long TS.Recent stays valid on an idle connection
+	// (RFC 7323, section 5.5).
+	pawsIdle = 24 * 24 * time.Hour
+)
+
+// timestamps is the Timestamps option state of a connection (RFC 7323).
+type timestamps struct {
+	ok     bool   // both SYNs carried the option
+	offset uint32 // random offset of our clock, so it reveals no uptime
+
+	// recent is the peer's TSval echoed in our segments, recentAt when it
+	// was taken.
+	recent   uint32
+	recentAt time.Time
+}
+
+func newTimestamps() timestamps {
+	return timestamps{offset: rand.Uint32()}
+}
+
+// tsNow returns the current value of our timestamp clock.
+func (c *TCPConnection) tsNow() uint32 {
+	return c.ts.offset + uint32(c.cfg.Clock.Now().UnixNano()/int64(tsTick))
+}
+
+// setTimestamps turns timestamps on if the peer's SYN carries the option,
+// which ours always does, and takes its first TSval. c.mu must be held.
+func (c *TCPConnection) setTimestamps(h *protocol.TCPHeader) {
+	opt, ok := h.Option(protocol.OptionTimestamps).(protocol.TimestampsOption)
+	c.ts.ok = ok
+	if ok {
+		c.ts.recent = opt.TSval
+		c.ts.recentAt = c.cfg.Clock.Now()
+	}
+}
+
+// stampTimestamps fills in the Timestamps option of an outgoing segment
+// with the current time and TS.Recent: in place for a SYN that offers it
+// and for retransmissions, prepended to the other options otherwise. RSTs
+// go without. c.mu must be held.
+func (c *TCPConnection) stampTimestamps(h *protocol.TCPHeader) {
+	ts := protocol.TimestampsOption{TSval: c.tsNow(), TSecr: c.ts.recent}
+	for i, o := range h.Options {
+		if o.Kind() == protocol.OptionTimestamps {
+			h.Options[i] = ts
+			return
+		}
+	}
+	if !c.ts.ok || h.ControlFlags&(protocol.SYN|protocol.RST) != 0 {
+		return
+	}
+	h.Options = append([]protocol.Option{protocol.NOPOption{}, protocol.NOPOption{}, ts}, h.Options...)
+}
+
+// timestampsLen is the option space stampTimestamps takes.
+func (c *TCPConnection) timestampsLen() int {
+	if !c.ts.ok {
+		return 0
+	}
+	return 2 + protocol.TimestampsOption{}.Len()
+}
+
+// checkPAWS rejects a segment whose TSval is older than TS.Recent: an old
+// duplicate from before the sequence numbers wrapped (RFC 7323, section
+// 5.3, R1). It is acknowledged unless it is a RST. A segment without the
+// option is dropped silently (section 3.2). c.mu must be held.
+func (c *TCPConnection) checkPAWS(h *protocol.TCPHeader) error {
+	if !c.ts.ok || h.ControlFlags&protocol.RST != 0 {
+		return nil
+	}
+	opt, ok := h.Option(protocol.OptionTimestamps).(protocol.TimestampsOption)
+	if !ok {
+		return fmt.Errorf("segment %d without timestamps", h.SeqNum)
+	}
+
+	if seqLT(opt.TSval, c.ts.recent) {
+		// After a long idle time TS.Recent may have wrapped itself
+		if c.cfg.Clock.Now().Sub(c.ts.recentAt) > pawsIdle {
+			c.ts.recent = opt.TSval
+			c.ts.recentAt = c.cfg.Clock.Now()
+			return nil
+		}
+		c.sendAck()
+		return fmt.Errorf("segment %d with TSval %d older than %d (PAWS)", h.SeqNum, opt.TSval, c.ts.recent)
+	}
+	return nil
+}
+
+// updateTSRecent records the TSval of an acceptable segment to be echoed,
+// unless it lies beyond what we acknowledged last (RFC 7323, section 4.3):
+// with data missing, the older TSval is echoed so the RTT it yields
+// includes the wait for the retransmission. c.mu must be held.
+func (c *TCPConnection) updateTSRecent(h *protocol.TCPHeader) {
+	opt, ok := h.Option(protocol.OptionTimestamps).(protocol.TimestampsOption)
+	if !c.ts.ok || !ok {
+		return
+	}
+	if seqGEQ(opt.TSval, c.ts.recent) && seqLEQ(h.SeqNum, c.lastAckSent) {
+		c.ts.recent = opt.TSval
+		c.ts.recentAt = c.cfg.Clock.Now()
+	}
+}
+
+// timestampRTT returns the round-trip time the TSecr of h yields (RFC
+// 7323, section 4.1), rounded up to the timestamp clock's tick.
+func (c *TCPConnection) timestampRTT(h *protocol.TCPHeader) (time.Duration, bool) {
+	opt, ok := h.Option(protocol.OptionTimestamps).(protocol.TimestampsOption)
+	if !c.ts.ok || !ok || opt.TSecr == 0 {
+		return 0, false
+	}
+	ticks := c.tsNow() - opt.TSecr
+	if ticks > 1<<31 {
+		return 0, false
+	}
+	return max(time.Duration(ticks)*tsTick, tsTick), true
+}
@@ -0,0 +1,192 @@
+package core
+
+import (
+	"log"
+	"tcplay/protocol"
+)
+
+const (
+	// maxWindow is the largest window the 16-bit header field can carry.
+	maxWindow = 0xffff
+
+	// maxWindowShift is the largest window scale shift, which allows
+	// windows of almost 1 GiB (RFC 7323, section 2.3).
+	maxWindowShift = 14
+)
+
+// windowShift returns the window scale shift to announce: the smallest one
+// that lets the whole receive buffer be advertised.
+func (c *TCPConnection) windowShift() uint8 {
+	shift := uint8(0)
+	for shift < maxWindowShift && c.cfg.ReceiveBufferSize>>shift > maxWindow {
+		shift++
+	}
+	return shift
+}
+
+// setWindowScale turns window scaling on if the peer's SYN carries the
+// option; ours always does, so a SYN-ACK with it completes the
+// negotiation. c.mu must be held.
+func (c *TCPConnection) setWindowScale(h *protocol.TCPHeader) {
+	opt, ok := h.Option(protocol.OptionWindowScale).(protocol.WindowScaleOption)
+	if !ok {
+		c.wscaleOK, c.sndWscale, c.rcvWscale = false, 0, 0
+		return
+	}
+	if opt.Shift > maxWindowShift {
+		log.Printf("Window scale shift %d of %v:%d too large, using %d", opt.Shift, c.destIP, c.destPort, maxWindowShift)
+		opt.Shift = maxWindowShift
+	}
+	c.wscaleOK = true
+	c.sndWscale = opt.Shift
+	c.rcvWscale = c.windowShift()
+}
+
+// peerWindow returns the window h advertises in bytes. The window of a SYN
+// is never scaled (RFC 7323, section 2.2).
+func (c *TCPConnection) peerWindow(h *protocol.TCPHeader) uint32 {
+	if h.ControlFlags&protocol.SYN != 0 {
+		return uint32(h.WindowSize)
+	}
+	return uint32(h.WindowSize) << c.sndWscale
+}
+
+// setSendWindow takes the peer's window from h and remembers which segment
+// it came from. c.mu must be held.
+func (c *TCPConnection) setSendWindow(h *protocol.TCPHeader) {
+	wnd := c.peerWindow(h)
+	opened := c.sndWnd == 0 && wnd > 0 && c.maxSndWnd > 0
+
+	c.sndWnd = wnd
+	c.sndWl1 = h.SeqNum
+	c.sndWl2 = h.AckNum
+	c.maxSndWnd = max(c.maxSndWnd, wnd)
+
+	if wnd > 0 {
+		c.stopPersistTimer()
+	}
+
+	// Whatever was sent into the zero window, a probe at least, was dropped
+	// by the peer: resend it now rather than after a backed-off RTO.
+	if opened && len(c.rtx.segments) > 0 {
+		c.retransmit(c.rtx.segments[0])
+	}
+}
+
+// updateSendWindow updates the send window from an acceptable ACK unless
+// the segment is older than the one the current window came from (RFC 9293,
+// section 3.10.7.4). c.mu must be held.
+func (c *TCPConnection) updateSendWindow(h *protocol.TCPHeader) {
+	if !seqLEQ(c.sndUna, h.AckNum) || !seqLEQ(h.AckNum, c.sndNxt) {
+		return
+	}
+	if seqLT(c.sndWl1, h.SeqNum) || (c.sndWl1 == h.SeqNum && seqLEQ(c.sndWl2, h.AckNum)) {
+		c.setSendWindow(h)
+	}
+}
+
+// usableWindow returns how many more bytes the peer's window and the
+// congestion window admit on top of what is in flight. In SACK recovery and
+// after a timeout the congestion window is measured against the pipe
+// estimate instead.
+func (c *TCPConnection) usableWindow() uint32 {
+	inFlight := c.sndNxt - c.sndUna
+	if inFlight >= c.sndWnd {
+		return 0
+	}
+	usable := c.sndWnd - inFlight
+
+	if c.scoreboardRecovery() {
+		inFlight = c.pipe()
+	}
+	cwnd := c.cwnd()
+	if inFlight >= cwnd {
+		return 0
+	}
+	return min(usable, cwnd-inFlight)
+}
+
+// swsThreshold is how far the receive window must be able to open before
+// it is advertised: min(MSS, half the buffer), RFC 1122, section 4.2.3.3.
+func (c *TCPConnection) swsThreshold() uint32 {
+	return min(uint32(c.maxSegSize), uint32(c.cfg.ReceiveBufferSize/2))
+}
+
+// advertisedWindow returns the window to put into an outgoing segment. The
+// right edge of the window (RCV.NXT + RCV.WND) only moves forward, and only
+// once it can move by swsThreshold, so the peer is never offered a handful
+// of bytes at a time (receiver-side SWS avoidance). c.mu must be held.
+func (c *TCPConnection) advertisedWindow() uint16 {
+	return c.advertise(c.rcvWscale)
+}
+
+// synWindow is advertisedWindow for a SYN or SYN-ACK, whose window is
+// never scaled. c.mu must be held.
+func (c *TCPConnection) synWindow() uint16 {
+	return c.advertise(0)
+}
+
+// advertise moves the right edge of the window as advertisedWindow
+// describes and returns the window scaled down by shift. The edge moves in
+// whole units of the scale so that the peer sees it where it is. c.mu must
+// be held.
+func (c *TCPConnection) advertise(shift uint8) uint16 {
+	edge := c.rcvNxt + c.maxRcvWnd(shift)
+	if seqGEQ(edge, c.rcvAdv+c.swsThreshold()) {
+		c.rcvAdv = edge
+	}
+	if seqLEQ(c.rcvAdv, c.rcvNxt) {
+		return 0
+	}
+	return uint16(min((c.rcvAdv-c.rcvNxt)>>shift, maxWindow))
+}
+
+// maxRcvWnd returns the receive window rounded down to what a window field
+// scaled by shift can carry.
+func (c *TCPConnection) maxRcvWnd(shift uint8) uint32 {
+	return min(c.rcvWnd(), maxWindow<<shift) >> shift << shift
+}
+
+// windowUpdateDue reports whether Read freed enough space that a peer
+// holding back on a small window should hear about it right away.
+func (c *TCPConnection) windowUpdateDue() bool {
+	threshold := c.swsThreshold()
+	wnd := uint32(0)
+	if seqGT(c.rcvAdv, c.rcvNxt) {
+		wnd = c.rcvAdv - c.rcvNxt
+	}
+	edge := c.rcvNxt + c.maxRcvWnd(c.rcvWscale)
+	return wnd < threshold && seqGEQ(edge, c.rcvAdv+threshold)
+}
+
+// startPersistTimer arms the persist timer when the peer's window is closed
+// and nothing is in flight whose ACK could open it again.
+func (c *TCPConnection) startPersistTimer() {
+	if !c.persist.running() {
+		c.arm(&c.persist, c.rtx.rto.rto, c.onPersistTimeout)
+	}
+}
+
+func (c *TCPConnection) stopPersistTimer() {
+	c.persist.stop()
+}
+
+// onPersistTimeout probes the zero window with one byte of new data (RFC
+// 9293, section 3.8.6.1). The probe is sent like any other segment, so from
+// here on the retransmission timer keeps probing with backoff until the
+// peer opens its window. c.mu must be held.
+func (c *TCPConnection) onPersistTimeout() {
+	if c.err != nil || !c.canOutput() || c.sndWnd > 0 || c.sndNxt != c.sndUna {
+		return
+	}
+
+	unsent := c.unsent()
+	if len(unsent) == 0 {
+		return
+	}
+
+	log.Printf("Probe zero window of %v:%d", c.destIP, c.destPort)
+	if err := c.sendData(unsent[:1], false); err != nil {
+		log.Printf("Failed to send window probe: %v", err)
+	}
+}
@@ -1,13 +1,29 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"tcplay/components/tcpnet"
 )
 
+var backend = flag.String("backend", "kernel", "TCP stack to dial with: kernel or tcplay")
+
+func dial(network, address string) (net.Conn, error) {
+	switch *backend {
+	case "kernel":
+		return net.Dial(network, address)
+	case "tcplay":
+		return tcpnet.Dial(network, address)
+	}
+	return nil, fmt.Errorf("unknown backend %q", *backend)
+}
+
 func main() {
-	conn, err := net.Dial("tcp", "localhost:42069")
+	flag.Parse()
+
+	conn, err := dial("tcp", "localhost:42069")
 	if err != nil {
 		log.Fatal("Error while creating connection:", err)
 	}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"tcplay/components/drill"
+)
+
+var verbose = flag.Bool("v", false, "show the stack's log")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: drill [-v] script.pkt...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	var runner drill.Runner
+	failed := 0
+	for _, name := range flag.Args() {
+		s, err := drill.ParseFile(name)
+		if err == nil {
+			err = runner.Run(s)
+		}
+
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s\n%v\n", name, err)
+			continue
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d scripts failed\n", failed, flag.NArg())
+		os.Exit(1)
+	}
+}
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"sync"
+	"tcplay/components/tcpnet"
 	"time"
 )
 
+var backend = flag.String("backend", "kernel", "TCP stack to listen with: kernel or tcplay")
+
+func listen(network, address string) (net.Listener, error) {
+	switch *backend {
+	case "kernel":
+		return net.Listen(network, address)
+	case "tcplay":
+		return tcpnet.Listen(network, address)
+	}
+	return nil, fmt.Errorf("unknown backend %q", *backend)
+}
+
 // Connection represents an active client connection
 type Connection struct {
 	ID        string
@@ -62,19 +77,21 @@ func (ct *ConnectionTracker) GetActiveConnections() []Connection {
 }
 
 func main() {
+	flag.Parse()
+
 	// Initialize the connection tracker
 	tracker := NewConnectionTracker()
 
 	// Create a custom logger with timestamp
 	logger := log.New(log.Writer(), "", log.Ldate|log.Ltime)
 
-	ln, err := net.Listen("tcp", ":42069")
+	ln, err := listen("tcp", ":42069")
 	if err != nil {
 		logger.Fatalf("Error listening on port 42069: %s", err)
 	}
 	defer ln.Close()
 
-	logger.Printf("Server started, listening on port 42069")
+	logger.Printf("Server started, listening on port 42069 (%s backend)", *backend)
 
 	for {
 		conn, err := ln.Accept()
@@ -28,15 +28,24 @@ type TCPHeader struct {
 	DestPort     uint16
 	SeqNum       uint32
 	AckNum       uint32
-	HeaderLen    uint8 // 4 bit field
+	HeaderLen    uint8 // 4 bit field, set by Serialize from Options
 	ControlFlags uint8
 	WindowSize   uint16
 	Checksum     uint16
 	UrgentPtr    uint16
+	Options      []Option
 }
 
-func (h *TCPHeader) Serialize() []byte {
-	header := make([]byte, 20) // Minimum TCP header size
+// Serialize encodes the header and its options, padded to a 32-bit
+// boundary. It sets HeaderLen to the resulting data offset.
+func (h *TCPHeader) Serialize() ([]byte, error) {
+	header := make([]byte, 20, 20+OptionsLen(h.Options)) // Minimum TCP header size
+
+	header, err := AppendOptions(header, h.Options)
+	if err != nil {
+		return nil, err
+	}
+	h.HeaderLen = uint8(len(header) / 4)
 
 	// Fill in the fields
 	binary.BigEndian.PutUint16(header[0:2], h.SourcePort)
@@ -44,17 +53,23 @@ func (h *TCPHeader) Serialize() []byte {
 	binary.BigEndian.PutUint32(header[4:8], h.SeqNum)
 	binary.BigEndian.PutUint32(header[8:12], h.AckNum)
 
-	// Data offset (5 for no options) and flags
-	header[12] = h.HeaderLen << 4 // Data offset (5 * 4 = 20 bytes header)
+	// Data offset (header length in 32-bit words) and flags
+	header[12] = h.HeaderLen << 4
 	header[13] = byte(h.ControlFlags)
 
 	binary.BigEndian.PutUint16(header[14:16], h.WindowSize)
-	binary.BigEndian.PutUint16(header[16:18], 0) // Checksum placeholder
+	binary.BigEndian.PutUint16(header[16:18], h.Checksum)
 	binary.BigEndian.PutUint16(header[18:20], h.UrgentPtr)
 
-	// Compute checksum (pseudo-header + TCP header + payload)
-	// checksum := computeChecksum(header)
-	// binary.BigEndian.PutUint16(header[16:18], checksum)
+	return header, nil
+}
 
-	return header
+// Option returns the first option of the given kind, or nil.
+func (h *TCPHeader) Option(kind uint8) Option {
+	for _, o := range h.Options {
+		if o.Kind() == kind {
+			return o
+		}
+	}
+	return nil
 }
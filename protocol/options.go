@@ -0,0 +1,278 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Option kinds (RFC 9293, RFC 7323, RFC 2018).
+const (
+	OptionEOL           = 0 // end of option list
+	OptionNOP           = 1 // no-operation
+	OptionMSS           = 2 // maximum segment size
+	OptionWindowScale   = 3
+	OptionSACKPermitted = 4
+	OptionSACK          = 5
+	OptionTimestamps    = 8
+)
+
+// MaxOptionsLen is the room for options in a header: a data offset of 15
+// words minus the fixed 20 bytes.
+const MaxOptionsLen = 40
+
+// Option is a TCP option. Known kinds have their own type; anything else is
+// carried through as UnknownOption.
+type Option interface {
+	// Kind returns the option kind byte.
+	Kind() uint8
+	// Len returns the encoded length, kind and length bytes included.
+	Len() int
+
+	appendTo(b []byte) []byte
+}
+
+// EOLOption marks the end of the option list.
+type EOLOption struct{}
+
+// NOPOption is used to align the options that follow it.
+type NOPOption struct{}
+
+// MSSOption announces the largest segment the sender is willing to receive.
+// It is only sent on SYN segments.
+//
+//	+--------+--------+---------+--------+
+//	|00000010|00000100|   max seg size   |
+//	+--------+--------+---------+--------+
+type MSSOption struct {
+	MSS uint16
+}
+
+// WindowScaleOption announces the shift count applied to the sender's
+// window field (RFC 7323, section 2).
+//
+//	+---------+---------+---------+
+//	| Kind=3  |Length=3 |shift.cnt|
+//	+---------+---------+---------+
+type WindowScaleOption struct {
+	Shift uint8
+}
+
+// SACKPermittedOption announces on a SYN that the sender understands SACK
+// blocks (RFC 2018, section 2).
+type SACKPermittedOption struct{}
+
+// SACKBlock is a contiguous block of data received beyond RCV.NXT: Left is
+// its first sequence number, Right the one following its last.
+type SACKBlock struct {
+	Left  uint32
+	Right uint32
+}
+
+// SACKOption reports the blocks of data received out of order (RFC 2018,
+// section 3).
+//
+//	                  +--------+--------+
+//	                  | Kind=5 | Length |
+//	+--------+--------+--------+--------+
+//	|      Left Edge of 1st Block       |
+//	+--------+--------+--------+--------+
+//	|      Right Edge of 1st Block      |
+//	+--------+--------+--------+--------+
+//	/            . . .                  /
+//	+--------+--------+--------+--------+
+type SACKOption struct {
+	Blocks []SACKBlock
+}
+
+// TimestampsOption carries the sender's clock and echoes the peer's (RFC
+// 7323, section 3).
+//
+//	+-------+-------+---------------------+---------------------+
+//	|Kind=8 |  10   |   TS Value (TSval)  |TS Echo Reply (TSecr)|
+//	+-------+-------+---------------------+---------------------+
+type TimestampsOption struct {
+	TSval uint32
+	TSecr uint32
+}
+
+// UnknownOption is an option of a kind this package does not interpret.
+// Data excludes the kind and length bytes.
+type UnknownOption struct {
+	Type uint8
+	Data []byte
+}
+
+func (EOLOption) Kind() uint8           { return OptionEOL }
+func (NOPOption) Kind() uint8           { return OptionNOP }
+func (MSSOption) Kind() uint8           { return OptionMSS }
+func (WindowScaleOption) Kind() uint8   { return OptionWindowScale }
+func (SACKPermittedOption) Kind() uint8 { return OptionSACKPermitted }
+func (SACKOption) Kind() uint8          { return OptionSACK }
+func (TimestampsOption) Kind() uint8    { return OptionTimestamps }
+func (o UnknownOption) Kind() uint8     { return o.Type }
+
+func (EOLOption) Len() int           { return 1 }
+func (NOPOption) Len() int           { return 1 }
+func (MSSOption) Len() int           { return 4 }
+func (WindowScaleOption) Len() int   { return 3 }
+func (SACKPermittedOption) Len() int { return 2 }
+func (o SACKOption) Len() int        { return 2 + 8*len(o.Blocks) }
+func (TimestampsOption) Len() int    { return 10 }
+func (o UnknownOption) Len() int     { return 2 + len(o.Data) }
+
+func (o EOLOption) appendTo(b []byte) []byte { return append(b, OptionEOL) }
+func (o NOPOption) appendTo(b []byte) []byte { return append(b, OptionNOP) }
+
+func (o MSSOption) appendTo(b []byte) []byte {
+	b = append(b, OptionMSS, byte(o.Len()))
+	return binary.BigEndian.AppendUint16(b, o.MSS)
+}
+
+func (o WindowScaleOption) appendTo(b []byte) []byte {
+	return append(b, OptionWindowScale, byte(o.Len()), o.Shift)
+}
+
+func (o SACKPermittedOption) appendTo(b []byte) []byte {
+	return append(b, OptionSACKPermitted, byte(o.Len()))
+}
+
+func (o SACKOption) appendTo(b []byte) []byte {
+	b = append(b, OptionSACK, byte(o.Len()))
+	for _, blk := range o.Blocks {
+		b = binary.BigEndian.AppendUint32(b, blk.Left)
+		b = binary.BigEndian.AppendUint32(b, blk.Right)
+	}
+	return b
+}
+
+func (o TimestampsOption) appendTo(b []byte) []byte {
+	b = append(b, OptionTimestamps, byte(o.Len()))
+	b = binary.BigEndian.AppendUint32(b, o.TSval)
+	return binary.BigEndian.AppendUint32(b, o.TSecr)
+}
+
+func (o UnknownOption) appendTo(b []byte) []byte {
+	b = append(b, o.Type, byte(o.Len()))
+	return append(b, o.Data...)
+}
+
+// OptionsLen returns the encoded length of opts padded to a multiple of 4
+// bytes.
+func OptionsLen(opts []Option) int {
+	n := 0
+	for _, o := range opts {
+		n += o.Len()
+	}
+	return (n + 3) &^ 3
+}
+
+// AppendOptions encodes opts to b and pads them with zero (EOL) bytes to a
+// 32-bit boundary.
+func AppendOptions(b []byte, opts []Option) ([]byte, error) {
+	start := len(b)
+	for _, o := range opts {
+		if o.Len() > 255 {
+			return nil, fmt.Errorf("option kind %d too long: %d bytes", o.Kind(), o.Len())
+		}
+		b = o.appendTo(b)
+	}
+	for (len(b)-start)%4 != 0 {
+		b = append(b, OptionEOL)
+	}
+
+	if n := len(b) - start; n > MaxOptionsLen {
+		return nil, fmt.Errorf("options too long: %d bytes, at most %d fit", n, MaxOptionsLen)
+	}
+	return b, nil
+}
+
+// ParseOptions decodes the options area of a header. Parsing stops at the
+// first EOL; everything after it is padding. An option whose length byte is
+// missing, too small, runs past the end of b, or does not match what its
+// kind requires is an error.
+func ParseOptions(b []byte) ([]Option, error) {
+	if len(b) > MaxOptionsLen {
+		return nil, fmt.Errorf("%w: %d bytes of options, at most %d fit", ErrMalformedOption, len(b), MaxOptionsLen)
+	}
+
+	var opts []Option
+	for len(b) > 0 {
+		kind := b[0]
+		switch kind {
+		case OptionEOL:
+			return opts, nil
+		case OptionNOP:
+			opts = append(opts, NOPOption{})
+			b = b[1:]
+			continue
+		}
+
+		if len(b) < 2 {
+			return nil, fmt.Errorf("%w: kind %d without length", ErrMalformedOption, kind)
+		}
+		n := int(b[1])
+		if n < 2 || n > len(b) {
+			return nil, fmt.Errorf("%w: kind %d with length %d, %d bytes left", ErrMalformedOption, kind, n, len(b))
+		}
+		data := b[2:n]
+		b = b[n:]
+
+		opt, err := parseOption(kind, data)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+// parseOption decodes the data of one option of the given kind.
+func parseOption(kind uint8, data []byte) (Option, error) {
+	wrongLen := func() error {
+		return fmt.Errorf("%w: kind %d with length %d", ErrMalformedOption, kind, len(data)+2)
+	}
+
+	switch kind {
+	case OptionMSS:
+		if len(data) != 2 {
+			return nil, wrongLen()
+		}
+		return MSSOption{MSS: binary.BigEndian.Uint16(data)}, nil
+
+	case OptionWindowScale:
+		if len(data) != 1 {
+			return nil, wrongLen()
+		}
+		return WindowScaleOption{Shift: data[0]}, nil
+
+	case OptionSACKPermitted:
+		if len(data) != 0 {
+			return nil, wrongLen()
+		}
+		return SACKPermittedOption{}, nil
+
+	case OptionSACK:
+		if len(data) == 0 || len(data)%8 != 0 {
+			return nil, wrongLen()
+		}
+		blocks := make([]SACKBlock, 0, len(data)/8)
+		for i := 0; i < len(data); i += 8 {
+			blocks = append(blocks, SACKBlock{
+				Left:  binary.BigEndian.Uint32(data[i : i+4]),
+				Right: binary.BigEndian.Uint32(data[i+4 : i+8]),
+			})
+		}
+		return SACKOption{Blocks: blocks}, nil
+
+	case OptionTimestamps:
+		if len(data) != 8 {
+			return nil, wrongLen()
+		}
+		return TimestampsOption{
+			TSval: binary.BigEndian.Uint32(data[0:4]),
+			TSecr: binary.BigEndian.Uint32(data[4:8]),
+		}, nil
+	}
+
+	return UnknownOption{Type: kind, Data: append([]byte(nil), data...)}, nil
+}
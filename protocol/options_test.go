@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// equalOptions compares decoded options, treating nil and empty lists as
+// equal.
+func equalOptions(a, b []Option) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestOptionsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		len  int // encoded and padded
+	}{
+		{name: "none", opts: nil, len: 0},
+		{name: "MSS", opts: []Option{MSSOption{MSS: 536}}, len: 4},
+		{name: "window scale padded", opts: []Option{WindowScaleOption{Shift: 14}}, len: 4},
+		{
+			name: "SYN",
+			opts: []Option{
+				MSSOption{MSS: 1460},
+				SACKPermittedOption{},
+				TimestampsOption{TSval: 0xdeadbeef, TSecr: 0},
+				NOPOption{},
+				WindowScaleOption{Shift: 7},
+			},
+			len: 20,
+		},
+		{
+			name: "SACK blocks",
+			opts: []Option{
+				NOPOption{},
+				NOPOption{},
+				SACKOption{Blocks: []SACKBlock{{Left: 1, Right: 2}, {Left: 0xfffffff0, Right: 0x10}}},
+			},
+			len: 20,
+		},
+		{
+			name: "40 bytes",
+			opts: []Option{
+				NOPOption{},
+				NOPOption{},
+				TimestampsOption{TSval: 1, TSecr: 2},
+				SACKOption{Blocks: []SACKBlock{{1, 2}, {3, 4}, {5, 6}}},
+			},
+			len: 40,
+		},
+		{
+			name: "unknown kinds",
+			opts: []Option{
+				UnknownOption{Type: 30, Data: []byte{1, 2, 3}},
+				UnknownOption{Type: 253},
+				MSSOption{MSS: 1},
+			},
+			len: 12,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := AppendOptions(nil, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != tt.len || OptionsLen(tt.opts) != tt.len {
+				t.Fatalf("encoded %d bytes, OptionsLen %d, want %d", len(b), OptionsLen(tt.opts), tt.len)
+			}
+
+			got, err := ParseOptions(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalOptions(got, tt.opts) {
+				t.Errorf("decoded %v, want %v", got, tt.opts)
+			}
+		})
+	}
+}
+
+func TestAppendOptionsPadsAfterPrefix(t *testing.T) {
+	prefix := []byte{0xaa, 0xbb, 0xcc}
+	b, err := AppendOptions(append([]byte(nil), prefix...), []Option{WindowScaleOption{Shift: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(prefix, OptionWindowScale, 3, 2, OptionEOL)
+	if !bytes.Equal(b, want) {
+		t.Errorf("encoded % x, want % x", b, want)
+	}
+}
+
+func TestAppendOptionsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{
+			name: "44 bytes",
+			opts: []Option{
+				TimestampsOption{},
+				SACKOption{Blocks: []SACKBlock{{1, 2}, {3, 4}, {5, 6}, {7, 8}}},
+			},
+		},
+		{
+			name: "41 bytes padded to 44",
+			opts: []Option{TimestampsOption{}, TimestampsOption{}, TimestampsOption{}, TimestampsOption{}, NOPOption{}},
+		},
+		{name: "option over 255 bytes", opts: []Option{UnknownOption{Type: 99, Data: make([]byte, 254)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if b, err := AppendOptions(nil, tt.opts); err == nil {
+				t.Errorf("encoded % x, want an error", b)
+			}
+		})
+	}
+}
+
+func TestParseOptionsEOL(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want []Option
+	}{
+		{name: "empty", b: nil, want: nil},
+		{name: "EOL only", b: []byte{OptionEOL, 0, 0, 0}, want: nil},
+		{name: "NOP padding", b: []byte{OptionNOP, OptionNOP, OptionNOP, OptionNOP}, want: []Option{NOPOption{}, NOPOption{}, NOPOption{}, NOPOption{}}},
+		{name: "EOL padding", b: []byte{OptionMSS, 4, 0x02, 0x18, OptionWindowScale, 3, 1, OptionEOL}, want: []Option{MSSOption{MSS: 536}, WindowScaleOption{Shift: 1}}},
+		{
+			// Whatever follows EOL is padding, even if it would not parse
+			name: "garbage after EOL",
+			b:    []byte{OptionNOP, OptionEOL, OptionMSS, 0, 0xff, 0xff},
+			want: []Option{NOPOption{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOptions(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalOptions(got, tt.want) {
+				t.Errorf("decoded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOptionsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{name: "length 0", b: []byte{OptionMSS, 0, 0, 0}},
+		{name: "length 1", b: []byte{30, 1, OptionNOP, OptionNOP}},
+		{name: "unknown kind with length 0", b: []byte{30, 0}},
+		{name: "length past the end", b: []byte{OptionTimestamps, 10, 0, 0, 0, 0, 0, 0}},
+		{name: "unknown kind past the end", b: []byte{OptionNOP, 30, 4, 1}},
+		{name: "kind without length", b: []byte{OptionNOP, OptionNOP, OptionNOP, OptionMSS}},
+		{name: "MSS length 3", b: []byte{OptionMSS, 3, 1, OptionEOL}},
+		{name: "window scale length 4", b: []byte{OptionWindowScale, 4, 1, 1}},
+		{name: "SACK-Permitted length 3", b: []byte{OptionSACKPermitted, 3, 0, OptionEOL}},
+		{name: "SACK without blocks", b: []byte{OptionSACK, 2, OptionNOP, OptionNOP}},
+		{name: "SACK with half a block", b: []byte{OptionSACK, 6, 0, 0, 0, 1}},
+		{name: "timestamps length 8", b: []byte{OptionTimestamps, 8, 0, 0, 0, 1, 0, 0}},
+		{name: "over 40 bytes", b: bytes.Repeat([]byte{OptionNOP}, 44)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := ParseOptions(tt.b)
+			if !errors.Is(err, ErrMalformedOption) {
+				t.Errorf("decoded %v, err %v; want ErrMalformedOption", opts, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// HeaderMinLen is the size of a TCP header without options.
+const HeaderMinLen = 20
+
+// Errors returned by ParseTCPHeader, wrapped with details.
+var (
+	ErrTruncated       = errors.New("segment shorter than TCP header")
+	ErrDataOffset      = errors.New("invalid data offset")
+	ErrMalformedOption = errors.New("malformed TCP option")
+)
+
+// ParseTCPHeader decodes a TCP segment: the fixed header, its options and
+// the payload after the data offset. The payload is a slice of b, not a
+// copy.
+func ParseTCPHeader(b []byte) (*TCPHeader, []byte, error) {
+	if len(b) < HeaderMinLen {
+		return nil, nil, fmt.Errorf("%w: %d bytes", ErrTruncated, len(b))
+	}
+
+	h := &TCPHeader{
+		SourcePort:   binary.BigEndian.Uint16(b[0:2]),
+		DestPort:     binary.BigEndian.Uint16(b[2:4]),
+		SeqNum:       binary.BigEndian.Uint32(b[4:8]),
+		AckNum:       binary.BigEndian.Uint32(b[8:12]),
+		HeaderLen:    b[12] >> 4,
+		ControlFlags: b[13] & 0x3F,
+		WindowSize:   binary.BigEndian.Uint16(b[14:16]),
+		Checksum:     binary.BigEndian.Uint16(b[16:18]),
+		UrgentPtr:    binary.BigEndian.Uint16(b[18:20]),
+	}
+
+	dataOffset := int(h.HeaderLen) * 4
+	if dataOffset < HeaderMinLen || dataOffset > len(b) {
+		return nil, nil, fmt.Errorf("%w: %d bytes for a %d byte segment", ErrDataOffset, dataOffset, len(b))
+	}
+
+	opts, err := ParseOptions(b[HeaderMinLen:dataOffset])
+	if err != nil {
+		return nil, nil, err
+	}
+	h.Options = opts
+
+	return h, b[dataOffset:], nil
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// segment returns a 20-byte header with the given data offset in words,
+// followed by rest.
+func segment(offset uint8, rest ...byte) []byte {
+	b := []byte{
+		0x30, 0x39, 0x00, 0x50, // ports 12345 -> 80
+		0x00, 0x00, 0x03, 0xe8, // seq 1000
+		0x00, 0x00, 0x07, 0xd0, // ack 2000
+		offset << 4, ACK | PSH,
+		0xff, 0xff, // window
+		0x12, 0x34, // checksum
+		0x00, 0x00, // urgent pointer
+	}
+	return append(b, rest...)
+}
+
+func TestParseTCPHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		err     error
+		opts    []Option
+		payload []byte
+	}{
+		{name: "empty", b: nil, err: ErrTruncated},
+		{name: "19 bytes", b: segment(5)[:19], err: ErrTruncated},
+		{name: "no options, no payload", b: segment(5), payload: []byte{}},
+		{name: "payload", b: segment(5, 'a', 'b', 'c'), payload: []byte("abc")},
+		{name: "data offset 0", b: segment(0, 'a', 'b', 'c', 'd'), err: ErrDataOffset},
+		{name: "data offset 4", b: segment(4, 'a', 'b', 'c', 'd'), err: ErrDataOffset},
+		{name: "data offset past the end", b: segment(6, 1, 1, 1), err: ErrDataOffset},
+		{name: "data offset 15 in 40 bytes", b: segment(15, make([]byte, 20)...), err: ErrDataOffset},
+		{
+			name:    "options then payload",
+			b:       segment(6, OptionMSS, 4, 0x05, 0xb4, 'x'),
+			opts:    []Option{MSSOption{MSS: 1460}},
+			payload: []byte("x"),
+		},
+		{
+			// The options area ends at the data offset: the payload is
+			// not read as options
+			name:    "payload looking like options",
+			b:       segment(6, OptionNOP, OptionNOP, OptionNOP, OptionNOP, OptionMSS, 4, 0x05, 0xb4),
+			opts:    []Option{NOPOption{}, NOPOption{}, NOPOption{}, NOPOption{}},
+			payload: []byte{OptionMSS, 4, 0x05, 0xb4},
+		},
+		{
+			name: "largest options area",
+			b:    segment(15, bytes.Repeat([]byte{OptionNOP}, 40)...),
+			opts: func() []Option {
+				opts := make([]Option, 40)
+				for i := range opts {
+					opts[i] = NOPOption{}
+				}
+				return opts
+			}(),
+			payload: []byte{},
+		},
+		{name: "malformed option", b: segment(6, OptionMSS, 5, 0, 0), err: ErrMalformedOption},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, payload, err := ParseTCPHeader(tt.b)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h.SourcePort != 12345 || h.DestPort != 80 || h.SeqNum != 1000 || h.AckNum != 2000 ||
+				h.ControlFlags != ACK|PSH || h.WindowSize != 0xffff || h.Checksum != 0x1234 || h.UrgentPtr != 0 {
+				t.Errorf("fixed fields decoded as %+v", h)
+			}
+			if int(h.HeaderLen)*4 != len(tt.b)-len(payload) {
+				t.Errorf("HeaderLen %d for %d header bytes", h.HeaderLen, len(tt.b)-len(payload))
+			}
+			if !equalOptions(h.Options, tt.opts) {
+				t.Errorf("options %v, want %v", h.Options, tt.opts)
+			}
+			if !bytes.Equal(payload, tt.payload) {
+				t.Errorf("payload %q, want %q", payload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestParseTCPHeaderPayloadAliasesInput(t *testing.T) {
+	b := segment(5, 'a', 'b')
+	_, payload, err := ParseTCPHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[20] = 'z'
+	if payload[0] != 'z' {
+		t.Errorf("payload is a copy of the segment, not a slice of it")
+	}
+}
+
+func TestSerializeParseRoundTrip(t *testing.T) {
+	h := &TCPHeader{
+		SourcePort:   40000,
+		DestPort:     443,
+		SeqNum:       0xfffffff0,
+		AckNum:       7,
+		ControlFlags: SYN | ACK,
+		WindowSize:   65535,
+		Options: []Option{
+			MSSOption{MSS: 1460},
+			SACKPermittedOption{},
+			TimestampsOption{TSval: 1, TSecr: 2},
+			NOPOption{},
+			WindowScaleOption{Shift: 7},
+		},
+	}
+	b, err := h.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = append(b, "data"...)
+
+	got, payload, err := ParseTCPHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SourcePort != h.SourcePort || got.DestPort != h.DestPort || got.SeqNum != h.SeqNum ||
+		got.AckNum != h.AckNum || got.ControlFlags != h.ControlFlags || got.WindowSize != h.WindowSize ||
+		got.HeaderLen != h.HeaderLen {
+		t.Errorf("decoded %+v, encoded %+v", got, h)
+	}
+	if !equalOptions(got.Options, h.Options) {
+		t.Errorf("options %v, want %v", got.Options, h.Options)
+	}
+	if string(payload) != "data" {
+		t.Errorf("payload %q", payload)
+	}
+}